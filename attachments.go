@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	// maxChirpAttachments is how many media files a single chirp can carry
+	maxChirpAttachments = 4
+	// unattachedMediaTTL is how long an upload can wait to be put in a chirp or a
+	// draft before the sweeper purges it
+	unattachedMediaTTL = 24 * time.Hour
+)
+
+var (
+	errInvalidAttachment  = errors.New("attachment does not exist, belongs to someone else or is already in use")
+	errAttachmentNotReady = errors.New("attachment is still processing or could not be processed")
+)
+
+// Attachments are processed in the background after upload
+const (
+	attachmentProcessing = "processing"
+	attachmentReady      = "ready"
+	attachmentFailed     = "failed"
+)
+
+// incomingPrefix is where raw uploads wait for processing. They may still carry
+// metadata, so blobs under it are never served.
+const incomingPrefix = "incoming/"
+
+// Attachment is an uploaded media file that can be attached to one chirp.
+// Url, the dimensions and the thumbnails are only set once processing has finished.
+type Attachment struct {
+	ID           string      `json:"id"`
+	Owner_ID     int64       `json:"owner_id"`
+	Chirp_ID     int         `json:"chirp_id,omitempty"`
+	Content_type string      `json:"content_type"`
+	Size         int64       `json:"size"`
+	Blob_key     string      `json:"blob_key"`
+	Url          string      `json:"url,omitempty"`
+	Status       string      `json:"status"`
+	Width        int         `json:"width,omitempty"`
+	Height       int         `json:"height,omitempty"`
+	Blurhash     string      `json:"blurhash,omitempty"`
+	Thumbnails   []Thumbnail `json:"thumbnails,omitempty"`
+	Created_at   time.Time   `json:"created_at"`
+}
+
+// Thumbnail is a scaled down copy of an image attachment
+type Thumbnail struct {
+	Name     string `json:"name"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Blob_key string `json:"blob_key"`
+	Url      string `json:"url"`
+}
+
+// blobKeys lists every blob stored for the attachment
+func (attachment Attachment) blobKeys() []string {
+	var keys []string
+	if attachment.Blob_key != "" {
+		keys = append(keys, attachment.Blob_key)
+	}
+	for _, thumbnail := range attachment.Thumbnails {
+		keys = append(keys, thumbnail.Blob_key)
+	}
+	return keys
+}
+
+// newAttachmentID returns a random ID that is safe to use in URLs and blob keys
+func newAttachmentID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// mediaURL is where a blob is served from
+func mediaURL(key string) string {
+	return "/media/" + key
+}
+
+// CreateAttachment records a stored upload that its owner can attach to a chirp
+func (db *DB) CreateAttachment(attachment Attachment) (Attachment, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	attachment.Created_at = time.Now().UTC()
+	attachment.Status = attachmentProcessing
+	dbStructure.Attachments[attachment.ID] = attachment
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	return attachment, nil
+}
+
+// checkAttachments reports whether the uploads can be attached to a new chirp by authorID.
+// Each one must belong to the author, must have been processed successfully and must
+// not be attached to another chirp already.
+func (dbStructure DBStructure) checkAttachments(authorID int64, attachmentIDs []string) error {
+	if len(attachmentIDs) > maxChirpAttachments {
+		return errInvalidAttachment
+	}
+	for i, id := range attachmentIDs {
+		attachment, found := dbStructure.Attachments[id]
+		if !found || attachment.Owner_ID != authorID || attachment.Chirp_ID != 0 {
+			return errInvalidAttachment
+		}
+		if attachment.Status != attachmentReady {
+			return errAttachmentNotReady
+		}
+		for _, other := range attachmentIDs[:i] {
+			if other == id {
+				return errInvalidAttachment
+			}
+		}
+	}
+	return nil
+}
+
+// attach links uploads that passed checkAttachments to a new chirp
+func (dbStructure DBStructure) attach(chirp Chirp) {
+	for _, id := range chirp.Attachment_IDs {
+		attachment := dbStructure.Attachments[id]
+		attachment.Chirp_ID = chirp.ID
+		dbStructure.Attachments[id] = attachment
+	}
+}
+
+// chirpAttachments returns the attachment records of a chirp in the order they were attached
+func (dbStructure DBStructure) chirpAttachments(chirp Chirp) []Attachment {
+	attachments := []Attachment{}
+	for _, id := range chirp.Attachment_IDs {
+		if attachment, found := dbStructure.Attachments[id]; found {
+			attachments = append(attachments, attachment)
+		}
+	}
+	return attachments
+}
+
+// PendingAttachments returns the attachments still waiting to be processed
+func (db *DB) PendingAttachments() ([]Attachment, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []Attachment{}
+	for _, attachment := range dbStructure.Attachments {
+		if attachment.Status == attachmentProcessing {
+			pending = append(pending, attachment)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Created_at.Before(pending[j].Created_at) })
+	return pending, nil
+}
+
+// FinishAttachment stores the result of processing an attachment. It returns
+// errInvalidAttachment if the attachment was deleted while it was being processed.
+func (db *DB) FinishAttachment(processed Attachment) (Attachment, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Attachment{}, err
+	}
+	attachment, found := dbStructure.Attachments[processed.ID]
+	if !found || attachment.Status != attachmentProcessing {
+		return Attachment{}, errInvalidAttachment
+	}
+
+	// Only the processing results are taken, the chirp may have been attached meanwhile
+	attachment.Status = processed.Status
+	attachment.Blob_key = processed.Blob_key
+	attachment.Size = processed.Size
+	attachment.Width = processed.Width
+	attachment.Height = processed.Height
+	attachment.Blurhash = processed.Blurhash
+	attachment.Thumbnails = processed.Thumbnails
+	attachment.Url = ""
+	if attachment.Status == attachmentReady {
+		attachment.Url = mediaURL(attachment.Blob_key)
+	}
+	dbStructure.Attachments[attachment.ID] = attachment
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	return attachment, nil
+}
+
+// PurgeUnattachedMedia deletes the uploads created before cutoff that were never
+// attached to a chirp or a draft, returning them so their blobs can be removed too
+func (db *DB) PurgeUnattachedMedia(cutoff time.Time) ([]Attachment, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	inDrafts := make(map[string]bool)
+	for _, draft := range dbStructure.Drafts {
+		for _, id := range draft.Attachment_IDs {
+			inDrafts[id] = true
+		}
+	}
+
+	purged := []Attachment{}
+	for id, attachment := range dbStructure.Attachments {
+		if attachment.Chirp_ID != 0 || inDrafts[id] || !attachment.Created_at.Before(cutoff) {
+			continue
+		}
+		purged = append(purged, attachment)
+		delete(dbStructure.Attachments, id)
+	}
+	if len(purged) == 0 {
+		return purged, nil
+	}
+
+	return purged, db.writeDB(dbStructure)
+}
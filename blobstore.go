@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var errBlobNotFound = errors.New("blob not found")
+
+// blobKeyPattern keeps keys to simple relative paths so they can't escape the store
+var blobKeyPattern = regexp.MustCompile(`^[a-z0-9_-]+(/[a-z0-9_-]+)*(\.[a-z0-9]+)?$`)
+
+// BlobStore keeps uploaded files such as chirp media and avatars
+type BlobStore interface {
+	// Put stores the contents of r under key, replacing anything already there
+	Put(key string, r io.Reader) error
+	// Open returns the blob stored under key, or errBlobNotFound
+	Open(key string) (io.ReadSeekCloser, error)
+	// Delete removes the blob stored under key. Deleting a missing blob is not an error.
+	Delete(key string) error
+}
+
+// localBlobStore is a BlobStore keeping every blob as a file under a directory
+type localBlobStore struct {
+	dir string
+}
+
+// newLocalBlobStore creates a blob store in dir, creating the directory if needed
+func newLocalBlobStore(dir string) (*localBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localBlobStore{dir: dir}, nil
+}
+
+func (store *localBlobStore) path(key string) (string, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(store.dir, filepath.FromSlash(key)), nil
+}
+
+func (store *localBlobStore) Put(key string, r io.Reader) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see half a blob
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (store *localBlobStore) Open(key string) (io.ReadSeekCloser, error) {
+	path, err := store.path(key)
+	if err != nil {
+		return nil, errBlobNotFound
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return file, err
+}
+
+func (store *localBlobStore) Delete(key string) error {
+	path, err := store.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
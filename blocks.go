@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	relationBlock = "block"
+	relationMute  = "mute"
+)
+
+var (
+	errBlocked       = errors.New("action not allowed between these users")
+	errRelateSelf    = errors.New("users cannot block or mute themselves")
+	errUnknownAction = errors.New("unknown relationship")
+)
+
+// hasBlock reports whether either user blocks the other
+func (dbStructure DBStructure) hasBlock(userA, userB int64) bool {
+	if _, found := dbStructure.Blocks[userA][userB]; found {
+		return true
+	}
+	_, found := dbStructure.Blocks[userB][userA]
+	return found
+}
+
+// hasMuted reports whether userID muted otherID
+func (dbStructure DBStructure) hasMuted(userID, otherID int64) bool {
+	_, found := dbStructure.Mutes[userID][otherID]
+	return found
+}
+
+// canView reports whether viewerID may see a chirp at all.
+// viewerID is 0 for anonymous requests.
+func (dbStructure DBStructure) canView(chirp Chirp, viewerID int64) bool {
+	if chirp.expired(time.Now()) {
+		return false
+	}
+	if (chirp.held() || chirp.Hidden) && viewerID != int64(chirp.Author_ID) {
+		return false
+	}
+	if !dbStructure.inAudience(chirp, viewerID) {
+		return false
+	}
+	if dbStructure.isSuspended(int64(chirp.Author_ID)) {
+		return false
+	}
+	if dbStructure.isShadowBanned(int64(chirp.Author_ID)) && viewerID != int64(chirp.Author_ID) {
+		return false
+	}
+	if viewerID != 0 && dbStructure.hasBlock(viewerID, int64(chirp.Author_ID)) {
+		return false
+	}
+	return true
+}
+
+// relationTable returns the map holding the given kind of relationship
+func (dbStructure DBStructure) relationTable(relation string) (map[int64]map[int64]time.Time, error) {
+	switch relation {
+	case relationBlock:
+		return dbStructure.Blocks, nil
+	case relationMute:
+		return dbStructure.Mutes, nil
+	}
+	return nil, errUnknownAction
+}
+
+// AddRelation makes userID block or mute otherID. Blocking also removes
+// any follow between the two users, in both directions.
+func (db *DB) AddRelation(relation string, userID, otherID int64) error {
+	if userID == otherID {
+		return errRelateSelf
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	if _, found := dbStructure.Users[otherID]; !found {
+		return errUserNotFound
+	}
+	table, err := dbStructure.relationTable(relation)
+	if err != nil {
+		return err
+	}
+
+	related := table[userID]
+	if related == nil {
+		related = make(map[int64]time.Time)
+		table[userID] = related
+	}
+	if _, found := related[otherID]; found {
+		return nil
+	}
+	related[otherID] = time.Now().UTC()
+
+	if relation == relationBlock {
+		delete(dbStructure.Follows[userID], otherID)
+		delete(dbStructure.Follows[otherID], userID)
+	}
+
+	return db.writeDB(dbStructure)
+}
+
+// RemoveRelation undoes a block or mute
+func (db *DB) RemoveRelation(relation string, userID, otherID int64) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	if _, found := dbStructure.Users[otherID]; !found {
+		return errUserNotFound
+	}
+	table, err := dbStructure.relationTable(relation)
+	if err != nil {
+		return err
+	}
+
+	if _, found := table[userID][otherID]; !found {
+		return nil
+	}
+	delete(table[userID], otherID)
+	if len(table[userID]) == 0 {
+		delete(table, userID)
+	}
+
+	return db.writeDB(dbStructure)
+}
+
+// GetRelations returns the users userID has blocked or muted, most recent first
+func (db *DB) GetRelations(relation string, userID int64) ([]User, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	table, err := dbStructure.relationTable(relation)
+	if err != nil {
+		return nil, err
+	}
+
+	related := table[userID]
+	users := []User{}
+	for otherID := range related {
+		if user, found := dbStructure.Users[otherID]; found {
+			users = append(users, user)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return related[users[i].ID].After(related[users[j].ID])
+	})
+
+	return users, nil
+}
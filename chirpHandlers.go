@@ -2,15 +2,19 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
 	"strconv"
-	"strings"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 )
 
+// maxThreadDepth caps how many levels of replies a thread request can return
+const maxThreadDepth = 50
+
 func (cfg *apiConfig) hitsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(200)
@@ -50,128 +54,297 @@ func (cfg *apiConfig) readyHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write(ok)
 }
 
-func (cfg *apiConfig) jsonHandler(w http.ResponseWriter, r *http.Request) {
-	type parameters struct {
-		Id           int    `json:"id"`
-		Body         string `json:"body"`
-		Error        string `json:"error"`
-		Valid        bool   `json:"valid"`
-		Cleaned_body string `json:"cleaned_body"`
+// validateChirpBody enforces the author's length limit and runs the body through moderation
+func validateChirpBody(body string, entitlements Entitlements, moderation *moderationPipeline) (moderationResult, error) {
+	if utf8.RuneCountInString(body) > entitlements.Max_chirp_length {
+		return moderationResult{}, fmt.Errorf("Chirp is too long")
 	}
+	result := moderation.Moderate(body)
+	if result.Action == moderationReject {
+		return moderationResult{}, errChirpRejected
+	}
+	return result, nil
+}
 
-	decoder := json.NewDecoder(r.Body)
-	params := parameters{}
-	err := decoder.Decode(&params)
-
-	errorString := ""
-	status := 200
-	valid := true
+func getChirp(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		viewerID, _ := userIDFromRequest(r, cfg.jwtSecret)
 
-	w.Header().Set("Content-Type", "application/json")
+		vars := mux.Vars(r)
+		chirpIDStr := vars["chirpID"]
+		chirpID, err := strconv.Atoi(chirpIDStr)
+		if err != nil {
+			http.Error(w, "Invalid chirp ID", 404)
+			return
+		}
 
-	if err != nil {
-		errorString = "Something went wrong"
-		status = 500
-		valid = false
+		view, err := db.GetChirpView(chirpID, viewerID)
+		if errors.Is(err, errChirpNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Issue getting chirps", 404)
+			return
+		}
 
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(view)
 	}
+}
 
-	if len(params.Body) > 140 {
-		errorString = "Chirp is too long"
-		status = 400
-		valid = false
-	}
-	cleanedBody := checkProfane(params.Body)
-	respBody := parameters{
-		Body:         params.Body,
-		Error:        errorString,
-		Valid:        valid,
-		Cleaned_body: cleanedBody,
-	}
+func deleteChirp(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
 
-	dat, err := json.Marshal(respBody)
-	if err != nil {
-		fmt.Printf("Error marshalling JSON: %s", err)
-		w.WriteHeader(500)
-		return
-	}
+		vars := mux.Vars(r)
+		chirpIDStr := vars["chirpID"]
+		chirpID, err := strconv.Atoi(chirpIDStr)
+		if err != nil {
+			http.Error(w, "Invalid chirp ID", 404)
+			return
+		}
 
-	w.WriteHeader(status)
-	w.Write(dat)
+		attachments, err := db.DeleteChirp(chirpID, int(userID))
+		if errors.Is(err, errChirpNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if errors.Is(err, errNotChirpAuthor) {
+			w.WriteHeader(403)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not delete chirp", http.StatusInternalServerError)
+			return
+		}
+		for _, attachment := range attachments {
+			for _, key := range attachment.blobKeys() {
+				cfg.blobStore.Delete(key)
+			}
+		}
 
+		w.WriteHeader(204)
+	}
 }
 
-func checkProfane(body string) string {
-	badWords := [3]string{"kerfuffle", "sharbert", "fornax"}
-	bodyText := strings.Split(body, " ")
+func rechirpChirp(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
 
-	result := []string{}
-	for _, word := range bodyText {
-		for _, badWord := range badWords {
-			if strings.ToLower(word) == badWord {
-				word = "****"
-				break
-			}
+		vars := mux.Vars(r)
+		chirpID, err := strconv.Atoi(vars["chirpID"])
+		if err != nil {
+			http.Error(w, "Invalid chirp ID", 404)
+			return
 		}
-		result = append(result, word)
-	}
 
-	return strings.Join(result, " ")
+		rechirp, created, err := db.Rechirp(chirpID, int(userID))
+		if errors.Is(err, errChirpNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if errors.Is(err, errNotShareable) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not rechirp", http.StatusInternalServerError)
+			return
+		}
+
+		views, err := db.chirpViews([]Chirp{rechirp}, userID)
+		if err != nil {
+			http.Error(w, "Could not rechirp", http.StatusInternalServerError)
+			return
+		}
+
+		if created {
+			w.WriteHeader(http.StatusCreated)
+		} else {
+			w.WriteHeader(200)
+		}
+		json.NewEncoder(w).Encode(views[0])
+	}
 }
 
-func getChirp(db *DB) http.HandlerFunc {
+func editChirp(db *DB, cfg *apiConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		chirps, err := db.loadDB()
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
 		if err != nil {
-			http.Error(w, "Issue getting chirps", 404)
+			w.WriteHeader(401)
 			return
 		}
 
 		vars := mux.Vars(r)
-		chirpIDStr := vars["chirpID"]
-		chirpID, err := strconv.Atoi(chirpIDStr)
+		chirpID, err := strconv.Atoi(vars["chirpID"])
 		if err != nil {
 			http.Error(w, "Invalid chirp ID", 404)
 			return
 		}
-		chirp, found := chirps.Chirps[chirpID]
-		if found {
-			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(chirp)
-		} else {
-			w.WriteHeader(404)
 
+		entitlements, err := db.GetEntitlements(userID)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		var reqBody map[string]string
+		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil || reqBody["body"] == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		moderated, err := validateChirpBody(reqBody["body"], entitlements, cfg.moderation)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		chirp, err := db.UpdateChirp(chirpID, int(userID), moderated.Body, entitlements.editWindow(), moderated.heldBy())
+		if errors.Is(err, errChirpNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if errors.Is(err, errNotChirpAuthor) {
+			w.WriteHeader(403)
+			return
+		}
+		if errors.Is(err, errNotEditable) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errEditWindowClosed) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, errChirpRejected) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		if err != nil {
+			http.Error(w, "Could not update chirp", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(chirp)
 	}
 }
 
-func deleteChirp(db *DB, cfg *apiConfig) http.HandlerFunc {
+func getChirpHistory(db *DB, cfg *apiConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		chirps, err := db.loadDB()
+		viewerID, _ := userIDFromRequest(r, cfg.jwtSecret)
+
+		vars := mux.Vars(r)
+		chirpID, err := strconv.Atoi(vars["chirpID"])
 		if err != nil {
-			http.Error(w, "Issue getting chirps", 404)
+			http.Error(w, "Invalid chirp ID", 404)
 			return
 		}
 
-		claims, _ := jwtValidate(r, cfg.jwtSecret)
+		history, err := db.GetChirpHistory(chirpID, viewerID)
+		if errors.Is(err, errChirpNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Issue getting chirp history", http.StatusInternalServerError)
+			return
+		}
 
-		authorID := claims.Subject
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(history)
+	}
+}
+
+func getChirpThread(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		viewerID, _ := userIDFromRequest(r, cfg.jwtSecret)
 
 		vars := mux.Vars(r)
-		chirpIDStr := vars["chirpID"]
-		chirpID, err := strconv.Atoi(chirpIDStr)
+		chirpID, err := strconv.Atoi(vars["chirpID"])
 		if err != nil {
 			http.Error(w, "Invalid chirp ID", 404)
 			return
 		}
-		chirp, found := chirps.Chirps[chirpID]
-		if found {
-			if fmt.Sprint(chirp.Author_ID) == authorID {
-				delete(chirps.Chirps, chirp.ID)
-				w.WriteHeader(204)
-			} else {
-				w.WriteHeader(403)
+
+		depth := maxThreadDepth
+		if depthStr := r.URL.Query().Get("depth"); depthStr != "" {
+			depth, err = strconv.Atoi(depthStr)
+			if err != nil || depth < 0 {
+				http.Error(w, "Invalid depth", http.StatusBadRequest)
+				return
 			}
+			if depth > maxThreadDepth {
+				depth = maxThreadDepth
+			}
+		}
+		newestFirst := r.URL.Query().Get("sort") == "desc"
+
+		thread, err := db.GetThread(chirpID, viewerID, depth, newestFirst)
+		if errors.Is(err, errChirpNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Issue getting thread", http.StatusInternalServerError)
+			return
 		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(thread)
+	}
+}
+
+func likeChirp(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return changeLike(cfg, db.LikeChirp, true)
+}
+
+func unlikeChirp(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return changeLike(cfg, db.UnlikeChirp, false)
+}
+
+// changeLike handles liking and unliking, which only differ in the DB call they make
+func changeLike(cfg *apiConfig, update func(chirpID int, userID int64) (int, error), liked bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		vars := mux.Vars(r)
+		chirpID, err := strconv.Atoi(vars["chirpID"])
+		if err != nil {
+			http.Error(w, "Invalid chirp ID", 404)
+			return
+		}
+
+		likeCount, err := update(chirpID, userID)
+		if errors.Is(err, errChirpNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not update like", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"like_count":  likeCount,
+			"liked_by_me": liked,
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(response)
 	}
 }
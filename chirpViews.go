@@ -0,0 +1,194 @@
+package main
+
+import (
+	"sort"
+)
+
+// chirpView is a chirp as returned by the API,
+// along with the counters derived from the rest of the database
+type chirpView struct {
+	Chirp
+	Author        *userSummary `json:"author"`
+	Attachments   []Attachment `json:"attachments"`
+	Reply_count   int          `json:"reply_count"`
+	Like_count    int          `json:"like_count"`
+	Liked_by_me   bool         `json:"liked_by_me"`
+	Rechirp_count int          `json:"rechirp_count"`
+	// Original is the shared chirp for rechirps and quote-chirps. It is nil with
+	// Original_unavailable set once the original has been deleted or can't be seen.
+	Original             *chirpView `json:"original,omitempty"`
+	Original_unavailable bool       `json:"original_unavailable,omitempty"`
+}
+
+// threadNode is a chirp in a conversation tree together with its replies
+type threadNode struct {
+	chirpView
+	// Unavailable marks a placeholder for a chirp that was deleted or can't be seen,
+	// kept so the replies under it stay in the tree. Only its ID is filled in.
+	Unavailable bool          `json:"unavailable,omitempty"`
+	Replies     []*threadNode `json:"replies"`
+}
+
+// chirpViews wraps chirps with their counters, keeping their order.
+// viewerID is the authenticated user making the request, 0 for anonymous requests.
+func (db *DB) chirpViews(chirps []Chirp, viewerID int64) ([]chirpView, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	return buildChirpViews(dbStructure, chirps, viewerID), nil
+}
+
+// GetChirpView returns a single chirp as viewerID sees it
+func (db *DB) GetChirpView(chirpID int, viewerID int64) (chirpView, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return chirpView{}, err
+	}
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found || !dbStructure.canView(chirp, viewerID) {
+		return chirpView{}, errChirpNotFound
+	}
+
+	return buildChirpViews(dbStructure, []Chirp{chirp}, viewerID)[0], nil
+}
+
+func buildChirpViews(dbStructure DBStructure, chirps []Chirp, viewerID int64) []chirpView {
+	replyCounts := make(map[int]int)
+	rechirpCounts := make(map[int]int)
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.In_reply_to != 0 && dbStructure.canView(chirp, viewerID) {
+			replyCounts[chirp.In_reply_to]++
+		}
+		if chirp.Original_ID != 0 {
+			rechirpCounts[chirp.Original_ID]++
+		}
+	}
+
+	newView := func(chirp Chirp) chirpView {
+		likes := dbStructure.Likes[chirp.ID]
+		_, liked := likes[viewerID]
+		var author *userSummary
+		if user, found := dbStructure.Users[int64(chirp.Author_ID)]; found {
+			summary := publicUser(user)
+			author = &summary
+		}
+		return chirpView{
+			Chirp:         chirp,
+			Author:        author,
+			Attachments:   dbStructure.chirpAttachments(chirp),
+			Reply_count:   replyCounts[chirp.ID],
+			Like_count:    len(likes),
+			Liked_by_me:   viewerID != 0 && liked,
+			Rechirp_count: rechirpCounts[chirp.ID],
+		}
+	}
+
+	views := make([]chirpView, 0, len(chirps))
+	for _, chirp := range chirps {
+		view := newView(chirp)
+		if chirp.Original_ID != 0 {
+			// Originals are never rechirps themselves, so this only nests one level
+			original, found := dbStructure.Chirps[chirp.Original_ID]
+			if found && dbStructure.canView(original, viewerID) {
+				originalView := newView(original)
+				view.Original = &originalView
+			} else {
+				view.Original_unavailable = true
+			}
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// GetThread returns the conversation chirpID belongs to as a tree, as viewerID sees it.
+// Chirps that were deleted or can't be seen become placeholders when visible replies
+// hang off them, and the tree starts from the highest chirp the requested one can
+// still be traced back to. Replies deeper than maxDepth levels below it are left out.
+func (db *DB) GetThread(chirpID int, viewerID int64, maxDepth int, newestFirst bool) (*threadNode, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found || !dbStructure.canView(chirp, viewerID) {
+		return nil, errChirpNotFound
+	}
+
+	var visible []Chirp
+	for _, other := range dbStructure.Chirps {
+		if other.conversationID() == chirp.conversationID() && dbStructure.canView(other, viewerID) {
+			visible = append(visible, other)
+		}
+	}
+	nodes := make(map[int]*threadNode)
+	for _, view := range buildChirpViews(dbStructure, visible, viewerID) {
+		nodes[view.ID] = &threadNode{chirpView: view, Replies: []*threadNode{}}
+	}
+
+	// Fill the gaps between visible chirps and the top of the conversation
+	for _, other := range visible {
+		parentID := other.In_reply_to
+		for parentID != 0 && nodes[parentID] == nil {
+			placeholder := &threadNode{Unavailable: true, Replies: []*threadNode{}}
+			placeholder.ID = parentID
+			nodes[parentID] = placeholder
+			// A deleted chirp takes its own parent with it, so the trail ends there
+			parent, found := dbStructure.Chirps[parentID]
+			if !found {
+				break
+			}
+			placeholder.In_reply_to = parent.In_reply_to
+			parentID = parent.In_reply_to
+		}
+	}
+
+	root := nodes[chirpID]
+	for root.In_reply_to != 0 && nodes[root.In_reply_to] != nil {
+		root = nodes[root.In_reply_to]
+	}
+	buildThread(nodes, root, maxDepth, newestFirst)
+
+	return root, nil
+}
+
+// buildThread attaches the nodes of a conversation to the tree under root.
+// Replies deeper than maxDepth levels below the root are left out.
+func buildThread(nodes map[int]*threadNode, root *threadNode, maxDepth int, newestFirst bool) {
+	children := make(map[int][]*threadNode)
+	for _, node := range nodes {
+		if node != root && node.In_reply_to != 0 {
+			children[node.In_reply_to] = append(children[node.In_reply_to], node)
+		}
+	}
+
+	var attach func(node *threadNode, depth int)
+	attach = func(node *threadNode, depth int) {
+		if depth >= maxDepth {
+			return
+		}
+		replies := children[node.ID]
+		sort.Slice(replies, func(i, j int) bool {
+			if newestFirst {
+				return replies[i].ID > replies[j].ID
+			}
+			return replies[i].ID < replies[j].ID
+		})
+		for _, reply := range replies {
+			node.Replies = append(node.Replies, reply)
+			attach(reply, depth+1)
+		}
+	}
+	attach(root, 0)
+}
@@ -2,20 +2,76 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"sort"
+	"strings"
 	"sync"
+	"time"
+)
+
+var (
+	errChirpNotFound    = errors.New("chirp not found")
+	errNotChirpAuthor   = errors.New("user is not the author of the chirp")
+	errNotEditable      = errors.New("rechirps cannot be edited")
+	errEditWindowClosed = errors.New("chirp can no longer be edited")
+	errHandleTaken      = errors.New("handle is already taken")
 )
 
 type DB struct {
 	path string
 	mux  *sync.RWMutex
+	// stream hears about every chirp change once it is written to disk
+	stream *chirpStream
+	// spam decides what happens to new and edited chirps that score as spam
+	spam spamPolicy
 }
 
 type Chirp struct {
-	ID        int    `json:"id"`
-	Body      string `json:"body"`
-	Author_ID int    `json:"author_id"`
+	ID   int    `json:"id"`
+	Body string `json:"body"`
+	// Visibility is public, followers or direct
+	Visibility string     `json:"visibility"`
+	Author_ID  int        `json:"author_id"`
+	Created_at time.Time  `json:"created_at"`
+	Edited_at  *time.Time `json:"edited_at"`
+	// In_reply_to is the ID of the chirp this one answers, 0 for top-level chirps
+	In_reply_to     int `json:"in_reply_to,omitempty"`
+	Conversation_ID int `json:"conversation_id"`
+	// Original_ID points at the chirp being shared. A plain rechirp has no body
+	// of its own, a quote-chirp adds one.
+	Original_ID int       `json:"original_id,omitempty"`
+	Hashtags    []string  `json:"hashtags,omitempty"`
+	Mentions    []Mention `json:"mentions,omitempty"`
+	// Attachment_IDs lists the uploaded media shown with the chirp
+	Attachment_IDs []string `json:"attachment_ids,omitempty"`
+	// Publish_at is when a scheduled draft goes out. Drafts without it wait
+	// until their author publishes them.
+	Publish_at *time.Time `json:"publish_at,omitempty"`
+	// Expires_at is when an ephemeral chirp disappears, nil for chirps that stay
+	Expires_at *time.Time `json:"expires_at,omitempty"`
+	// Held_by names the moderation rules holding the chirp for review.
+	// Held chirps are only visible to their author.
+	Held_by []string `json:"held_by,omitempty"`
+	// Hidden chirps were taken down by a moderator and are only visible to their author
+	Hidden bool `json:"hidden,omitempty"`
+}
+
+// ChirpOptions holds the optional settings of a new chirp
+type ChirpOptions struct {
+	InReplyTo     int
+	QuoteOf       int
+	AttachmentIDs []string
+	ExpiresAt     *time.Time
+	HeldBy        []string
+	// Visibility defaults to the parent's for replies and to public otherwise
+	Visibility string
+}
+
+// ChirpRevision is a previous version of an edited chirp
+type ChirpRevision struct {
+	Body       string    `json:"body"`
+	Created_at time.Time `json:"created_at"`
 }
 
 type User struct {
@@ -25,11 +81,65 @@ type User struct {
 	Expires_in_seconds int64  `json:"expires_in_seconds,omitempty"`
 	Token              string `json:"token"`
 	Is_chirpy_red      bool   `json:"is_chirpy_red"`
+	// Handle is stored lowercased and is unique across users
+	Handle       string   `json:"handle,omitempty"`
+	Display_name string   `json:"display_name,omitempty"`
+	Bio          string   `json:"bio,omitempty"`
+	Links        []string `json:"links,omitempty"`
+	Avatar_url   string   `json:"avatar_url,omitempty"`
+	Is_moderator bool     `json:"is_moderator,omitempty"`
+	// Suspended_at is set while the user is suspended by a moderator.
+	// Suspended_until ends a time-limited suspension, nil means indefinite.
+	Suspended_at    *time.Time `json:"suspended_at,omitempty"`
+	Suspended_until *time.Time `json:"suspended_until,omitempty"`
+	Shadow_banned   bool       `json:"shadow_banned,omitempty"`
+	// Created_at is zero for users from before it was recorded
+	Created_at time.Time `json:"created_at"`
+	// Notification_preferences turns types of notification on or off, all are on unless set
+	Notification_preferences map[string]bool `json:"notification_preferences,omitempty"`
 }
 
 type DBStructure struct {
-	Chirps map[int]Chirp  `json:"chirps"`
-	Users  map[int64]User `json:"users"`
+	Chirps    map[int]Chirp           `json:"chirps"`
+	Users     map[int64]User          `json:"users"`
+	Revisions map[int][]ChirpRevision `json:"revisions"`
+	// Likes maps a chirp ID to the users who liked it and when
+	Likes map[int]map[int64]time.Time `json:"likes"`
+	// Hashtags maps a lowercased hashtag to the IDs of the chirps using it, in ascending order
+	Hashtags      map[string][]int     `json:"hashtags"`
+	Notifications map[int]Notification `json:"notifications"`
+	// SearchIndex maps a stemmed term to the chirps containing it and the word positions it appears at
+	SearchIndex map[string]map[int][]int `json:"search_index"`
+	// SearchWords maps an unstemmed word to the chirps containing it and how often,
+	// so prefix searches can match words whose stem is shorter than the prefix
+	SearchWords map[string]map[int]int `json:"search_words"`
+	// Follows maps a follower's ID to the users they follow and since when
+	Follows map[int64]map[int64]time.Time `json:"follows"`
+	// Timelines holds the fanned-out chirp IDs of each user's home timeline, in ascending order
+	Timelines map[int64][]int `json:"timelines"`
+	// Blocks and Mutes map a user's ID to the users they blocked or muted and since when
+	Blocks map[int64]map[int64]time.Time `json:"blocks"`
+	Mutes  map[int64]map[int64]time.Time `json:"mutes"`
+	// Attachments holds uploaded media by attachment ID
+	Attachments map[string]Attachment `json:"attachments"`
+	// Drafts holds unpublished and scheduled chirps by draft ID
+	Drafts map[int]Draft `json:"drafts"`
+	// ModerationCases holds reported and held chirps awaiting or past review, by case ID
+	ModerationCases map[int]ModerationCase `json:"moderation_cases"`
+	// ModerationLog is the audit trail of moderation decisions, by entry ID
+	ModerationLog map[int]ModerationLogEntry `json:"moderation_log"`
+	// Conversations and Messages hold direct messages, by conversation and message ID
+	Conversations map[int]Conversation `json:"conversations"`
+	Messages      map[int]Message      `json:"messages"`
+	// SpamScores is how spammy each chirp looked when it was last posted or edited,
+	// from 0 to 1. It is kept apart from the chirps so only moderators ever see it.
+	SpamScores map[int]float64 `json:"spam_scores"`
+	// Sequences holds the last ID handed out for each table whose IDs must never
+	// be reused, by table name
+	Sequences map[string]int `json:"sequences"`
+
+	// events collects the chirp changes to stream once this state is written
+	events *[]chirpEvent
 }
 
 type PolkaEvent struct {
@@ -45,8 +155,10 @@ type EventData struct {
 // and creates the database file if it doesn't exist
 func NewDB(path string) (*DB, error) {
 	db := &DB{
-		path: path,
-		mux:  &sync.RWMutex{},
+		path:   path,
+		mux:    &sync.RWMutex{},
+		stream: newChirpStream(),
+		spam:   defaultSpamPolicy,
 	}
 	if err := db.ensureDB(); err != nil {
 		return nil, err
@@ -55,8 +167,56 @@ func NewDB(path string) (*DB, error) {
 	return db, nil
 }
 
+// conversationID returns the ID of the chirp that started this chirp's conversation
+func (c Chirp) conversationID() int {
+	// Chirps stored before threading existed start their own conversation
+	if c.Conversation_ID == 0 {
+		return c.ID
+	}
+	return c.Conversation_ID
+}
+
+// held reports whether the chirp is waiting for a moderator
+func (c Chirp) held() bool {
+	return len(c.Held_by) > 0
+}
+
+// isRechirp reports whether the chirp only shares another chirp without adding a body
+func (c Chirp) isRechirp() bool {
+	return c.Original_ID != 0 && c.Body == "" && len(c.Attachment_IDs) == 0
+}
+
+// nextSequenceID hands out the next ID of a table whose IDs must never be reused
+func (dbStructure DBStructure) nextSequenceID(table string) int {
+	dbStructure.Sequences[table]++
+	return dbStructure.Sequences[table]
+}
+
+// chirpSequence names the sequence chirp IDs come from. They are never reused, so
+// nothing still pointing at a deleted chirp can end up at a newer one.
+const chirpSequence = "chirps"
+
+// sharedOriginal resolves the chirp that should be shared when userID shares chirpID.
+// Sharing a plain rechirp shares the chirp it points at instead.
+func sharedOriginal(dbStructure DBStructure, chirpID int, userID int64) (Chirp, error) {
+	original, found := dbStructure.Chirps[chirpID]
+	if !found || !dbStructure.canView(original, userID) {
+		return Chirp{}, errChirpNotFound
+	}
+	if original.isRechirp() {
+		original, found = dbStructure.Chirps[original.Original_ID]
+		if !found || !dbStructure.canView(original, userID) {
+			return Chirp{}, errChirpNotFound
+		}
+	}
+	if original.Visibility != visibilityPublic {
+		return Chirp{}, errNotShareable
+	}
+	return original, nil
+}
+
 // CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string, userID int) (Chirp, error) {
+func (db *DB) CreateChirp(body string, userID int, opts ChirpOptions) (Chirp, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
@@ -66,26 +226,302 @@ func (db *DB) CreateChirp(body string, userID int) (Chirp, error) {
 		return Chirp{}, err
 	}
 
+	newChirp, err := dbStructure.publishChirp(body, userID, opts, db.spam)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	// Write the updated database to the file
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return newChirp, nil
+}
+
+// checkChirpOptions reports whether userID can currently reply to, quote and attach what opts asks for
+func (dbStructure DBStructure) checkChirpOptions(userID int, opts ChirpOptions) error {
+	if opts.ExpiresAt != nil && !opts.ExpiresAt.After(time.Now()) {
+		return errExpiryPassed
+	}
+	if opts.InReplyTo != 0 {
+		parent, found := dbStructure.Chirps[opts.InReplyTo]
+		if !found || parent.expired(time.Now()) || !dbStructure.inAudience(parent, int64(userID)) {
+			return errChirpNotFound
+		}
+		if dbStructure.hasBlock(int64(userID), int64(parent.Author_ID)) {
+			return errBlocked
+		}
+	}
+	if opts.QuoteOf != 0 {
+		if _, err := sharedOriginal(dbStructure, opts.QuoteOf, int64(userID)); err != nil {
+			return err
+		}
+	}
+	return dbStructure.checkAttachments(int64(userID), opts.AttachmentIDs)
+}
+
+// publishChirp adds a new chirp to the in-memory database along with everything
+// that follows from it: indexes, mention notifications and timeline fan-out.
+// Every way of publishing goes through here, so every new chirp is scored for spam.
+func (dbStructure DBStructure) publishChirp(body string, userID int, opts ChirpOptions, spam spamPolicy) (Chirp, error) {
+	if err := dbStructure.checkChirpOptions(userID, opts); err != nil {
+		return Chirp{}, err
+	}
+	spamScore, heldBy, err := dbStructure.screenSpam(userID, body, 0, opts.HeldBy, spam)
+	if err != nil {
+		return Chirp{}, err
+	}
+
 	// Find a unique ID for the new chirp
-	newID := len(dbStructure.Chirps) + 1
+	newID := dbStructure.nextSequenceID(chirpSequence)
 
 	// Create the new chirp
 	newChirp := Chirp{
-		ID:        newID,
-		Body:      body,
-		Author_ID: userID,
+		ID:         newID,
+		Body:       body,
+		Author_ID:  userID,
+		Created_at: time.Now().UTC(),
+		Hashtags:   extractHashtags(body),
+		Mentions:   resolveMentions(dbStructure, body, int64(userID)),
 	}
 
+	// Replies join the conversation of the chirp they answer
+	newChirp.Conversation_ID = newID
+	if opts.InReplyTo != 0 {
+		parent := dbStructure.Chirps[opts.InReplyTo]
+		newChirp.In_reply_to = parent.ID
+		newChirp.Conversation_ID = parent.conversationID()
+	}
+	if opts.QuoteOf != 0 {
+		original, _ := sharedOriginal(dbStructure, opts.QuoteOf, int64(userID))
+		newChirp.Original_ID = original.ID
+	}
+	newChirp.Attachment_IDs = opts.AttachmentIDs
+	newChirp.Expires_at = opts.ExpiresAt
+	newChirp.Visibility = dbStructure.chirpVisibility(opts)
+	newChirp.Held_by = heldBy
+	dbStructure.attach(newChirp)
+
 	// Add the chirp to the in-memory database structure
 	dbStructure.Chirps[newID] = newChirp
+	dbStructure.SpamScores[newID] = spamScore
+	dbStructure.indexHashtags(newChirp)
+	dbStructure.indexChirpText(newChirp)
+	dbStructure.emit(eventChirpCreated, newChirp)
+	if newChirp.held() {
+		dbStructure.holdForReview(newChirp)
+	} else {
+		dbStructure.notifyChirp(newChirp)
+	}
+	dbStructure.fanOut(newChirp)
+
+	return newChirp, nil
+}
+
+// Rechirp shares a chirp without adding a body. A user rechirping the same
+// chirp twice gets back their existing rechirp, with created set to false.
+func (db *DB) Rechirp(chirpID int, userID int) (rechirp Chirp, created bool, err error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Chirp{}, false, err
+	}
+
+	original, err := sharedOriginal(dbStructure, chirpID, int64(userID))
+	if err != nil {
+		return Chirp{}, false, err
+	}
+
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.isRechirp() && chirp.Original_ID == original.ID && chirp.Author_ID == userID {
+			return chirp, false, nil
+		}
+	}
+
+	newID := dbStructure.nextSequenceID(chirpSequence)
+	rechirp = Chirp{
+		ID:              newID,
+		Author_ID:       userID,
+		Created_at:      time.Now().UTC(),
+		Conversation_ID: newID,
+		Original_ID:     original.ID,
+		Visibility:      visibilityPublic,
+	}
+	dbStructure.Chirps[newID] = rechirp
+	dbStructure.emit(eventChirpCreated, rechirp)
+	dbStructure.fanOut(rechirp)
 
-	// Write the updated database to the file
 	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Chirp{}, false, err
+	}
+
+	return rechirp, true, nil
+}
+
+// DeleteChirp removes a chirp owned by userID along with its likes, history and
+// attachment records, returning the attachments so their blobs can be removed too.
+// Plain rechirps of it are removed too since they have nothing left to show;
+// quote-chirps keep their own body and only lose the embedded original.
+func (db *DB) DeleteChirp(chirpID int, userID int) ([]Attachment, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found {
+		return nil, errChirpNotFound
+	}
+	if chirp.Author_ID != userID {
+		return nil, errNotChirpAuthor
+	}
+
+	attachments := dbStructure.removeChirp(chirp)
+
+	return attachments, db.writeDB(dbStructure)
+}
+
+// removeChirp deletes a chirp and everything hanging off it from the in-memory
+// database, closing its open moderation cases, and returns its attachments so
+// their blobs can be removed too
+func (dbStructure DBStructure) removeChirp(chirp Chirp) []Attachment {
+	attachments := dbStructure.chirpAttachments(chirp)
+	for _, attachment := range attachments {
+		delete(dbStructure.Attachments, attachment.ID)
+	}
+
+	removed := []int{chirp.ID}
+	for _, other := range dbStructure.Chirps {
+		if other.isRechirp() && other.Original_ID == chirp.ID {
+			removed = append(removed, other.ID)
+		}
+	}
+	for _, id := range removed {
+		dbStructure.emit(eventChirpDeleted, dbStructure.Chirps[id])
+		dbStructure.closeCases(dbStructure.Chirps[id])
+		dbStructure.unindexHashtags(dbStructure.Chirps[id])
+		dbStructure.unindexChirpText(dbStructure.Chirps[id])
+		delete(dbStructure.Chirps, id)
+		delete(dbStructure.Revisions, id)
+		delete(dbStructure.Likes, id)
+		delete(dbStructure.SpamScores, id)
+	}
+	for notificationID, notification := range dbStructure.Notifications {
+		for _, id := range removed {
+			if notification.Chirp_ID == id {
+				delete(dbStructure.Notifications, notificationID)
+			}
+		}
+	}
+
+	return attachments
+}
+
+// UpdateChirp replaces the body of a chirp owned by userID, keeping the previous
+// version in the chirp's revision history. Chirps older than editWindow can't be changed.
+// heldBy lists the moderation rules that want the new body reviewed, if any.
+func (db *DB) UpdateChirp(chirpID int, userID int, body string, editWindow time.Duration, heldBy []string) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
 	if err != nil {
 		return Chirp{}, err
 	}
 
-	return newChirp, nil
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found || chirp.expired(time.Now()) {
+		return Chirp{}, errChirpNotFound
+	}
+	if chirp.Author_ID != userID {
+		return Chirp{}, errNotChirpAuthor
+	}
+	if chirp.isRechirp() {
+		return Chirp{}, errNotEditable
+	}
+	if time.Since(chirp.Created_at) > editWindow {
+		return Chirp{}, errEditWindowClosed
+	}
+	spamScore, heldBy, err := dbStructure.screenSpam(userID, body, chirpID, heldBy, db.spam)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	// The previous version was written either at creation or at the last edit
+	previousAt := chirp.Created_at
+	if chirp.Edited_at != nil {
+		previousAt = *chirp.Edited_at
+	}
+	dbStructure.Revisions[chirpID] = append(dbStructure.Revisions[chirpID], ChirpRevision{
+		Body:       chirp.Body,
+		Created_at: previousAt,
+	})
+
+	editedAt := time.Now().UTC()
+	dbStructure.unindexHashtags(chirp)
+	dbStructure.unindexChirpText(chirp)
+	previousMentions := chirp.Mentions
+	chirp.Body = body
+	chirp.Edited_at = &editedAt
+	chirp.Hashtags = extractHashtags(body)
+	chirp.Mentions = resolveMentions(dbStructure, body, int64(userID))
+	if len(heldBy) > 0 {
+		// Everyone but the author loses sight of the chirp until it is reviewed
+		dbStructure.emit(eventChirpDeleted, dbStructure.Chirps[chirpID])
+		chirp.Held_by = heldBy
+		dbStructure.holdForReview(chirp)
+	}
+	dbStructure.Chirps[chirpID] = chirp
+	dbStructure.SpamScores[chirpID] = spamScore
+	dbStructure.indexHashtags(chirp)
+	dbStructure.indexChirpText(chirp)
+	dbStructure.emit(eventChirpUpdated, chirp)
+	dbStructure.pruneMentionNotifications(chirp)
+	if !chirp.held() {
+		dbStructure.notifyMentions(chirp, previousMentions)
+	}
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+// GetChirpHistory returns every version of a chirp, oldest first,
+// ending with the current one
+func (db *DB) GetChirpHistory(chirpID int, viewerID int64) ([]ChirpRevision, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found || !dbStructure.canView(chirp, viewerID) {
+		return nil, errChirpNotFound
+	}
+
+	currentAt := chirp.Created_at
+	if chirp.Edited_at != nil {
+		currentAt = *chirp.Edited_at
+	}
+
+	history := append([]ChirpRevision{}, dbStructure.Revisions[chirpID]...)
+	history = append(history, ChirpRevision{Body: chirp.Body, Created_at: currentAt})
+
+	return history, nil
 }
 
 // GetChirps returns all chirps in the database
@@ -116,14 +552,131 @@ func (db *DB) GetChirps() ([]Chirp, error) {
 	return chirps, nil
 }
 
+// LikeChirp records that a user likes a chirp and returns the new like count.
+// Liking a chirp twice has no further effect.
+func (db *DB) LikeChirp(chirpID int, userID int64) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return 0, err
+	}
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found || !dbStructure.canView(chirp, userID) {
+		return 0, errChirpNotFound
+	}
+
+	likes := dbStructure.Likes[chirpID]
+	if likes == nil {
+		likes = make(map[int64]time.Time)
+		dbStructure.Likes[chirpID] = likes
+	}
+	if _, liked := likes[userID]; liked {
+		return len(likes), nil
+	}
+	likes[userID] = time.Now().UTC()
+	dbStructure.addNotification(int64(chirp.Author_ID), notificationLike, userID, chirp.ID)
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(likes), nil
+}
+
+// UnlikeChirp removes a user's like from a chirp and returns the new like count
+func (db *DB) UnlikeChirp(chirpID int, userID int64) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return 0, err
+	}
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found {
+		return 0, errChirpNotFound
+	}
+
+	likes := dbStructure.Likes[chirpID]
+	if _, liked := likes[userID]; !liked {
+		return len(likes), nil
+	}
+	delete(likes, userID)
+	dbStructure.removeNotification(int64(chirp.Author_ID), notificationLike, userID, chirp.ID)
+	if len(likes) == 0 {
+		delete(dbStructure.Likes, chirpID)
+	}
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(likes), nil
+}
+
+// GetLikedChirps returns the chirps a user has liked that viewerID may see, most recently liked first
+func (db *DB) GetLikedChirps(userID int64, viewerID int64) ([]Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	if _, found := dbStructure.Users[userID]; !found {
+		return nil, errUserNotFound
+	}
+
+	likedAt := make(map[int]time.Time)
+	var chirps []Chirp
+	for chirpID, likes := range dbStructure.Likes {
+		chirp, found := dbStructure.Chirps[chirpID]
+		if !found || !dbStructure.canView(chirp, viewerID) {
+			continue
+		}
+		if at, liked := likes[userID]; liked {
+			likedAt[chirpID] = at
+			chirps = append(chirps, chirp)
+		}
+	}
+
+	sort.Slice(chirps, func(i, j int) bool {
+		return likedAt[chirps[i].ID].After(likedAt[chirps[j].ID])
+	})
+
+	return chirps, nil
+}
+
 // ensureDB creates a new database file if it doesn't exist
 func (db *DB) ensureDB() error {
 	_, err := os.Stat(db.path)
 	if os.IsNotExist(err) {
 		// If not, create a new database file with an empty chirps map
 		emptyDB := DBStructure{
-			Chirps: make(map[int]Chirp),
-			Users:  make(map[int64]User),
+			Chirps:          make(map[int]Chirp),
+			Users:           make(map[int64]User),
+			Revisions:       make(map[int][]ChirpRevision),
+			Likes:           make(map[int]map[int64]time.Time),
+			Hashtags:        make(map[string][]int),
+			Notifications:   make(map[int]Notification),
+			SearchIndex:     make(map[string]map[int][]int),
+			SearchWords:     make(map[string]map[int]int),
+			Follows:         make(map[int64]map[int64]time.Time),
+			Timelines:       make(map[int64][]int),
+			Blocks:          make(map[int64]map[int64]time.Time),
+			Mutes:           make(map[int64]map[int64]time.Time),
+			Attachments:     make(map[string]Attachment),
+			Drafts:          make(map[int]Draft),
+			ModerationCases: make(map[int]ModerationCase),
+			ModerationLog:   make(map[int]ModerationLogEntry),
+			Conversations:   make(map[int]Conversation),
+			Messages:        make(map[int]Message),
+			SpamScores:      make(map[int]float64),
+			Sequences:       make(map[string]int),
 		}
 		return db.writeDB(emptyDB)
 	}
@@ -141,10 +694,17 @@ func (db *DB) CreateUser(body map[string]string) (User, error) {
 	}
 	newID := int64(len(dbStructure.Users) + 1)
 
+	handle := strings.ToLower(body["handle"])
+	if handle != "" && dbStructure.handleTaken(handle, newID) {
+		return User{}, errHandleTaken
+	}
+
 	newUser := User{
-		ID:       newID,
-		Email:    body["email"],
-		Password: body["password"],
+		ID:         newID,
+		Email:      body["email"],
+		Password:   body["password"],
+		Handle:     handle,
+		Created_at: time.Now().UTC(),
 	}
 
 	dbStructure.Users[newUser.ID] = newUser
@@ -157,12 +717,219 @@ func (db *DB) CreateUser(body map[string]string) (User, error) {
 	return newUser, nil
 }
 
+// handleTaken reports whether a user other than userID already uses the handle
+func (dbStructure DBStructure) handleTaken(handle string, userID int64) bool {
+	for _, user := range dbStructure.Users {
+		if user.ID != userID && user.Handle == strings.ToLower(handle) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetUserByEmail looks up the user with the given email address
+func (db *DB) GetUserByEmail(email string) (User, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return User{}, err
+	}
+	for _, user := range dbStructure.Users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return User{}, errUserNotFound
+}
+
+// GetUserByRefreshToken looks up the user a refresh token was issued to
+func (db *DB) GetUserByRefreshToken(token string) (User, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return User{}, err
+	}
+	for _, user := range dbStructure.Users {
+		if token != "" && user.Token == token {
+			return user, nil
+		}
+	}
+	return User{}, errUserNotFound
+}
+
+// SaveLogin stores the refresh token issued to a user who just logged in, along
+// with how long the access tokens refreshed from it should last
+func (db *DB) SaveLogin(userID int64, refreshToken string, expiresInSeconds int64) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	user, found := dbStructure.Users[userID]
+	if !found {
+		return errUserNotFound
+	}
+	user.Token = refreshToken
+	user.Expires_in_seconds = expiresInSeconds
+	dbStructure.Users[userID] = user
+
+	return db.writeDB(dbStructure)
+}
+
+// RevokeRefreshToken forgets a refresh token so it can't be used again
+func (db *DB) RevokeRefreshToken(token string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	for id, user := range dbStructure.Users {
+		if token != "" && user.Token == token {
+			user.Token = ""
+			dbStructure.Users[id] = user
+		}
+	}
+
+	return db.writeDB(dbStructure)
+}
+
+// UpdateCredentials changes a user's email address and password hash
+func (db *DB) UpdateCredentials(userID int64, email, passwordHash string) (User, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return User{}, err
+	}
+	user, found := dbStructure.Users[userID]
+	if !found {
+		return User{}, errUserNotFound
+	}
+	user.Email = email
+	user.Password = passwordHash
+	dbStructure.Users[userID] = user
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// UpgradeUser gives a user Chirpy Red
+func (db *DB) UpgradeUser(userID int64) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	user, found := dbStructure.Users[userID]
+	if !found {
+		return errUserNotFound
+	}
+	user.Is_chirpy_red = true
+	dbStructure.Users[userID] = user
+
+	return db.writeDB(dbStructure)
+}
+
 // loadDB reads the database file into memory
 func (db *DB) loadDB() (DBStructure, error) {
 	var chirps = DBStructure{}
 	res, _ := os.ReadFile(db.path)
 
 	err := json.Unmarshal(res, &chirps)
+	chirps.events = &[]chirpEvent{}
+
+	// Databases written before a table existed won't have it yet
+	if chirps.Revisions == nil {
+		chirps.Revisions = make(map[int][]ChirpRevision)
+	}
+	if chirps.Likes == nil {
+		chirps.Likes = make(map[int]map[int64]time.Time)
+	}
+	if chirps.Hashtags == nil {
+		// Older chirps were never indexed, so index them all once
+		chirps.rebuildHashtagIndex()
+	}
+	if chirps.Notifications == nil {
+		chirps.Notifications = make(map[int]Notification)
+	}
+	if chirps.SearchIndex == nil || chirps.SearchWords == nil {
+		chirps.rebuildSearchIndex()
+	}
+	if chirps.Follows == nil {
+		chirps.Follows = make(map[int64]map[int64]time.Time)
+	}
+	if chirps.Timelines == nil {
+		chirps.Timelines = make(map[int64][]int)
+	}
+	if chirps.Blocks == nil {
+		chirps.Blocks = make(map[int64]map[int64]time.Time)
+	}
+	if chirps.Mutes == nil {
+		chirps.Mutes = make(map[int64]map[int64]time.Time)
+	}
+	if chirps.Attachments == nil {
+		chirps.Attachments = make(map[string]Attachment)
+	}
+	if chirps.Drafts == nil {
+		chirps.Drafts = make(map[int]Draft)
+	}
+	if chirps.ModerationCases == nil {
+		chirps.ModerationCases = make(map[int]ModerationCase)
+	}
+	if chirps.ModerationLog == nil {
+		chirps.ModerationLog = make(map[int]ModerationLogEntry)
+	}
+	if chirps.Conversations == nil {
+		chirps.Conversations = make(map[int]Conversation)
+	}
+	if chirps.Messages == nil {
+		chirps.Messages = make(map[int]Message)
+	}
+	if chirps.SpamScores == nil {
+		chirps.SpamScores = make(map[int]float64)
+	}
+	if chirps.Sequences == nil {
+		chirps.Sequences = make(map[string]int)
+	}
+	// Chirps, drafts and notifications from before their sequence existed keep their IDs
+	for id := range chirps.Chirps {
+		chirps.Sequences[chirpSequence] = max(chirps.Sequences[chirpSequence], id)
+	}
+	for id := range chirps.Drafts {
+		chirps.Sequences[draftSequence] = max(chirps.Sequences[draftSequence], id)
+	}
+	for id := range chirps.Notifications {
+		chirps.Sequences[notificationSequence] = max(chirps.Sequences[notificationSequence], id)
+	}
+	for id, chirp := range chirps.Chirps {
+		// Chirps from before visibility levels existed were all public
+		if chirp.Visibility == "" {
+			chirp.Visibility = visibilityPublic
+			chirps.Chirps[id] = chirp
+		}
+	}
+	for id, attachment := range chirps.Attachments {
+		// Uploads from before processing existed were served as they are
+		if attachment.Status == "" {
+			attachment.Status = attachmentReady
+			chirps.Attachments[id] = attachment
+		}
+	}
 
 	return chirps, err
 }
@@ -175,6 +942,10 @@ func (db *DB) writeDB(dbStructure DBStructure) error {
 	}
 
 	err = os.WriteFile(db.path, res, os.ModePerm)
+	if err == nil && dbStructure.events != nil && db.stream != nil {
+		db.stream.publish(*dbStructure.events, dbStructure)
+		*dbStructure.events = nil
+	}
 
 	return err
 }
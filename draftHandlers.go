@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// saveDraft creates a draft, or replaces the one named in the URL.
+// A draft with publish_at set is published by the scheduler at that time.
+func saveDraft(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+		entitlements, err := db.GetEntitlements(userID)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		draftID := 0
+		if id, ok := mux.Vars(r)["draftID"]; ok {
+			draftID, err = strconv.Atoi(id)
+			if err != nil {
+				http.Error(w, "Invalid draft ID", 404)
+				return
+			}
+		}
+
+		var reqBody chirpRequest
+		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		moderated, err := reqBody.validate(entitlements, cfg.moderation)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts := reqBody.options()
+		opts.HeldBy = moderated.heldBy()
+
+		draft, err := db.SaveDraft(draftID, moderated.Body, int(userID), opts, reqBody.Publish_at, entitlements.Max_scheduled_chirps)
+		if errors.Is(err, errDraftNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if errors.Is(err, errTooManyScheduled) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if writeChirpOptionsError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not save draft", http.StatusInternalServerError)
+			return
+		}
+
+		status := 200
+		if draftID == 0 {
+			status = http.StatusCreated
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(draft)
+	}
+}
+
+// getDrafts lists the user's drafts; ?scheduled=true or false narrows the list down
+func getDrafts(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		drafts, err := db.GetDrafts(int(userID))
+		if err != nil {
+			http.Error(w, "Could not retrieve drafts", http.StatusInternalServerError)
+			return
+		}
+
+		if scheduled := r.URL.Query().Get("scheduled"); scheduled != "" {
+			want, err := strconv.ParseBool(scheduled)
+			if err != nil {
+				http.Error(w, "Invalid scheduled filter", http.StatusBadRequest)
+				return
+			}
+			filtered := []Draft{}
+			for _, draft := range drafts {
+				if (draft.Publish_at != nil) == want {
+					filtered = append(filtered, draft)
+				}
+			}
+			drafts = filtered
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(drafts)
+	}
+}
+
+func getDraft(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		draftID, err := strconv.Atoi(mux.Vars(r)["draftID"])
+		if err != nil {
+			http.Error(w, "Invalid draft ID", 404)
+			return
+		}
+
+		draft, err := db.GetDraft(draftID, int(userID))
+		if errors.Is(err, errDraftNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not retrieve draft", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(draft)
+	}
+}
+
+// deleteDraft discards a draft, which also cancels a scheduled chirp
+func deleteDraft(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		draftID, err := strconv.Atoi(mux.Vars(r)["draftID"])
+		if err != nil {
+			http.Error(w, "Invalid draft ID", 404)
+			return
+		}
+
+		err = db.DeleteDraft(draftID, int(userID))
+		if errors.Is(err, errDraftNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not delete draft", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// publishDraft publishes a draft right away, whether or not it was scheduled
+func publishDraft(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		draftID, err := strconv.Atoi(mux.Vars(r)["draftID"])
+		if err != nil {
+			http.Error(w, "Invalid draft ID", 404)
+			return
+		}
+
+		chirp, err := db.PublishDraft(draftID, int(userID))
+		if errors.Is(err, errDraftNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if writeChirpOptionsError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not publish draft", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(chirp)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// maxScheduleAhead is how far in the future a chirp can be scheduled
+	maxScheduleAhead = 365 * 24 * time.Hour
+	// schedulerInterval is how often the scheduler looks for chirps that are due
+	schedulerInterval = 5 * time.Second
+)
+
+var (
+	errDraftNotFound    = errors.New("draft not found")
+	errTooManyScheduled = errors.New("too many scheduled chirps")
+)
+
+// Draft is a chirp that hasn't been published yet. Only its author can see it.
+// Scheduled drafts have Publish_at set and are published by the scheduler.
+type Draft struct {
+	Chirp
+	// Publish_error explains why a scheduled draft could not be published,
+	// in which case it is unscheduled and left for its author to fix
+	Publish_error string `json:"publish_error,omitempty"`
+}
+
+// options returns the settings the draft will be published with
+func (draft Draft) options() ChirpOptions {
+	return ChirpOptions{
+		InReplyTo:     draft.In_reply_to,
+		QuoteOf:       draft.Original_ID,
+		AttachmentIDs: draft.Attachment_IDs,
+		ExpiresAt:     draft.Expires_at,
+		HeldBy:        draft.Held_by,
+		Visibility:    draft.Visibility,
+	}
+}
+
+// draftSequence names the sequence draft IDs come from. They are never reused, so a
+// client holding on to a deleted draft can't change a newer one. Drafts get a new
+// chirp ID when they are published so chirp IDs keep following publication order.
+const draftSequence = "drafts"
+
+// SaveDraft creates a draft, or replaces the draft with draftID if it isn't 0.
+// The reply, quote and attachments are checked now so mistakes show up early;
+// they are checked again when the draft is published. A user can have at most
+// maxScheduled drafts scheduled at once.
+func (db *DB) SaveDraft(draftID int, body string, userID int, opts ChirpOptions, publishAt *time.Time, maxScheduled int) (Draft, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Draft{}, err
+	}
+
+	draft := Draft{Chirp: Chirp{Author_ID: userID, Created_at: time.Now().UTC()}}
+	if draftID == 0 {
+		draft.ID = dbStructure.nextSequenceID(draftSequence)
+	} else {
+		existing, found := dbStructure.Drafts[draftID]
+		if !found || existing.Author_ID != userID {
+			return Draft{}, errDraftNotFound
+		}
+		draft.ID = existing.ID
+		draft.Created_at = existing.Created_at
+		now := time.Now().UTC()
+		draft.Edited_at = &now
+	}
+
+	if err := dbStructure.checkChirpOptions(userID, opts); err != nil {
+		return Draft{}, err
+	}
+	if publishAt != nil {
+		scheduled := 0
+		for _, other := range dbStructure.Drafts {
+			if other.Author_ID == userID && other.Publish_at != nil && other.ID != draft.ID {
+				scheduled++
+			}
+		}
+		if scheduled >= maxScheduled {
+			return Draft{}, errTooManyScheduled
+		}
+	}
+	draft.Body = body
+	draft.In_reply_to = opts.InReplyTo
+	draft.Original_ID = opts.QuoteOf
+	draft.Attachment_IDs = opts.AttachmentIDs
+	draft.Expires_at = opts.ExpiresAt
+	draft.Held_by = opts.HeldBy
+	draft.Visibility = opts.Visibility
+	draft.Publish_at = publishAt
+	dbStructure.Drafts[draft.ID] = draft
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Draft{}, err
+	}
+
+	return draft, nil
+}
+
+// GetDraft returns one of userID's drafts
+func (db *DB) GetDraft(draftID int, userID int) (Draft, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Draft{}, err
+	}
+
+	draft, found := dbStructure.Drafts[draftID]
+	if !found || draft.Author_ID != userID {
+		return Draft{}, errDraftNotFound
+	}
+	return draft, nil
+}
+
+// GetDrafts lists userID's drafts. Scheduled drafts come first in the order they
+// will be published, followed by the rest, newest first.
+func (db *DB) GetDrafts(userID int) ([]Draft, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	drafts := []Draft{}
+	for _, draft := range dbStructure.Drafts {
+		if draft.Author_ID == userID {
+			drafts = append(drafts, draft)
+		}
+	}
+	sort.Slice(drafts, func(i, j int) bool {
+		a, b := drafts[i].Publish_at, drafts[j].Publish_at
+		if (a == nil) != (b == nil) {
+			return a != nil
+		}
+		if a != nil && !a.Equal(*b) {
+			return a.Before(*b)
+		}
+		return drafts[i].ID > drafts[j].ID
+	})
+	return drafts, nil
+}
+
+// DeleteDraft discards a draft, cancelling it if it was scheduled
+func (db *DB) DeleteDraft(draftID int, userID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	draft, found := dbStructure.Drafts[draftID]
+	if !found || draft.Author_ID != userID {
+		return errDraftNotFound
+	}
+	delete(dbStructure.Drafts, draftID)
+
+	return db.writeDB(dbStructure)
+}
+
+// PublishDraft publishes one of userID's drafts right away
+func (db *DB) PublishDraft(draftID int, userID int) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	draft, found := dbStructure.Drafts[draftID]
+	if !found || draft.Author_ID != userID {
+		return Chirp{}, errDraftNotFound
+	}
+	chirp, err := dbStructure.publishChirp(draft.Body, draft.Author_ID, draft.options(), db.spam)
+	if err != nil {
+		return Chirp{}, err
+	}
+	delete(dbStructure.Drafts, draftID)
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+// PublishDueDrafts publishes every scheduled draft whose time has come. Drafts that
+// can no longer be published, say because the chirp they reply to was deleted, are
+// unscheduled with the reason recorded for their author. Drafts whose author is
+// posting too fast stay scheduled and go out on a later run.
+func (db *DB) PublishDueDrafts(now time.Time) ([]Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	var due []Draft
+	for _, draft := range dbStructure.Drafts {
+		if draft.Publish_at != nil && !draft.Publish_at.After(now) {
+			due = append(due, draft)
+		}
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].Publish_at.Equal(*due[j].Publish_at) {
+			return due[i].Publish_at.Before(*due[j].Publish_at)
+		}
+		return due[i].ID < due[j].ID
+	})
+
+	published := []Chirp{}
+	for _, draft := range due {
+		chirp, err := dbStructure.publishChirp(draft.Body, draft.Author_ID, draft.options(), db.spam)
+		var tooFast postingTooFastError
+		if errors.As(err, &tooFast) {
+			continue
+		}
+		if err != nil {
+			draft.Publish_at = nil
+			draft.Publish_error = err.Error()
+			dbStructure.Drafts[draft.ID] = draft
+			continue
+		}
+		delete(dbStructure.Drafts, draft.ID)
+		published = append(published, chirp)
+	}
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return nil, err
+	}
+
+	return published, nil
+}
+
+// chirpScheduler publishes scheduled drafts when they are due. The schedule lives
+// in the database, so drafts that came due while the server was down go out as
+// soon as it starts again.
+type chirpScheduler struct {
+	db *DB
+}
+
+func newChirpScheduler(db *DB) *chirpScheduler {
+	return &chirpScheduler{db: db}
+}
+
+// Start publishes anything already due and keeps checking in the background
+func (s *chirpScheduler) Start() {
+	s.publishDue()
+	go func() {
+		ticker := time.NewTicker(schedulerInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.publishDue()
+		}
+	}()
+}
+
+func (s *chirpScheduler) publishDue() {
+	published, err := s.db.PublishDueDrafts(time.Now().UTC())
+	if err != nil {
+		log.Printf("publishing scheduled chirps failed: %v", err)
+		return
+	}
+	if len(published) > 0 {
+		log.Printf("published %d scheduled chirps", len(published))
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+)
+
+// Membership tiers. Users become Chirpy Red members through the Polka webhook.
+const (
+	tierFree = "free"
+	tierRed  = "chirpy_red"
+)
+
+// Entitlements are the limits that apply to a user's chirps
+type Entitlements struct {
+	Tier             string `json:"tier"`
+	Max_chirp_length int    `json:"max_chirp_length"`
+	// Edit_window_seconds is how long after posting a chirp can still be edited
+	Edit_window_seconds  int64 `json:"edit_window_seconds"`
+	Max_scheduled_chirps int   `json:"max_scheduled_chirps"`
+	Max_attachments      int   `json:"max_attachments"`
+}
+
+// tierEntitlements configures what each tier is allowed to do
+var tierEntitlements = map[string]Entitlements{
+	tierFree: {
+		Tier:                 tierFree,
+		Max_chirp_length:     140,
+		Edit_window_seconds:  int64((15 * time.Minute).Seconds()),
+		Max_scheduled_chirps: 5,
+		Max_attachments:      2,
+	},
+	tierRed: {
+		Tier:                 tierRed,
+		Max_chirp_length:     1000,
+		Edit_window_seconds:  int64((24 * time.Hour).Seconds()),
+		Max_scheduled_chirps: 100,
+		Max_attachments:      maxChirpAttachments,
+	},
+}
+
+// editWindow is how long after posting a chirp can still be edited
+func (entitlements Entitlements) editWindow() time.Duration {
+	return time.Duration(entitlements.Edit_window_seconds) * time.Second
+}
+
+// tier returns the membership tier the user belongs to
+func (user User) tier() string {
+	if user.Is_chirpy_red {
+		return tierRed
+	}
+	return tierFree
+}
+
+// GetEntitlements returns the limits that currently apply to userID
+func (db *DB) GetEntitlements(userID int64) (Entitlements, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Entitlements{}, err
+	}
+
+	user, found := dbStructure.Users[userID]
+	if !found {
+		return Entitlements{}, errUserNotFound
+	}
+	return tierEntitlements[user.tier()], nil
+}
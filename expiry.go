@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	minChirpTTL = time.Minute
+	maxChirpTTL = 365 * 24 * time.Hour
+	// defaultExpiryGrace is how long expired chirps stay in the database before
+	// they are purged, unless CHIRP_EXPIRY_GRACE says otherwise
+	defaultExpiryGrace = 24 * time.Hour
+	// sweepInterval is how often the sweeper looks for expired chirps to purge
+	sweepInterval = time.Minute
+)
+
+var errExpiryPassed = errors.New("chirp would already have expired")
+
+// expired reports whether an ephemeral chirp has reached its expiry time.
+// Expired chirps are hidden from everyone until the sweeper purges them.
+func (c Chirp) expired(now time.Time) bool {
+	return c.Expires_at != nil && !c.Expires_at.After(now)
+}
+
+// PurgeExpiredChirps deletes the chirps that expired before cutoff, returning the
+// attachments they carried so their blobs can be removed too
+func (db *DB) PurgeExpiredChirps(cutoff time.Time) ([]Attachment, int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var expired []Chirp
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.expired(cutoff) {
+			expired = append(expired, chirp)
+		}
+	}
+	if len(expired) == 0 {
+		return nil, 0, nil
+	}
+
+	attachments := []Attachment{}
+	for _, chirp := range expired {
+		attachments = append(attachments, dbStructure.removeChirp(chirp)...)
+	}
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return attachments, len(expired), nil
+}
+
+// chirpSweeper purges expired chirps in the background once their grace period
+// is over. Until then they are only hidden, which leaves room to look into
+// reports about them. It also purges uploads that were never attached to anything.
+type chirpSweeper struct {
+	db        *DB
+	blobStore BlobStore
+	grace     time.Duration
+}
+
+func newChirpSweeper(db *DB, blobStore BlobStore, grace time.Duration) *chirpSweeper {
+	return &chirpSweeper{db: db, blobStore: blobStore, grace: grace}
+}
+
+// Start purges anything already past its grace period and keeps sweeping in the background
+func (s *chirpSweeper) Start() {
+	s.sweep()
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.sweep()
+		}
+	}()
+}
+
+func (s *chirpSweeper) sweep() {
+	attachments, purged, err := s.db.PurgeExpiredChirps(time.Now().Add(-s.grace))
+	if err != nil {
+		log.Printf("purging expired chirps failed: %v", err)
+		return
+	}
+	for _, attachment := range attachments {
+		for _, key := range attachment.blobKeys() {
+			s.blobStore.Delete(key)
+		}
+	}
+	if purged > 0 {
+		log.Printf("purged %d expired chirps", purged)
+	}
+
+	unattached, err := s.db.PurgeUnattachedMedia(time.Now().Add(-unattachedMediaTTL))
+	if err != nil {
+		log.Printf("purging unattached media failed: %v", err)
+		return
+	}
+	for _, attachment := range unattached {
+		for _, key := range attachment.blobKeys() {
+			s.blobStore.Delete(key)
+		}
+	}
+	if len(unattached) > 0 {
+		log.Printf("purged %d unattached uploads", len(unattached))
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+func followUser(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return changeFollow(cfg, db.Follow)
+}
+
+func unfollowUser(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return changeFollow(cfg, db.Unfollow)
+}
+
+// changeFollow handles following and unfollowing, which only differ in the DB call they make
+func changeFollow(cfg *apiConfig, update func(followerID, followeeID int64) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		vars := mux.Vars(r)
+		followeeID, err := strconv.ParseInt(vars["userID"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", 404)
+			return
+		}
+
+		err = update(userID, followeeID)
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if errors.Is(err, errFollowSelf) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errBlocked) {
+			http.Error(w, "Cannot follow this user", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not update follow", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(204)
+	}
+}
+
+func getFollowers(db *DB) http.HandlerFunc {
+	return listFollows(db.GetFollowers)
+}
+
+func getFollowing(db *DB) http.HandlerFunc {
+	return listFollows(db.GetFollowing)
+}
+
+// listFollows responds with one side of a user's follow graph and its size
+func listFollows(list func(userID int64) ([]User, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		userID, err := strconv.ParseInt(vars["userID"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", 404)
+			return
+		}
+
+		users, err := list(userID)
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not retrieve users", http.StatusInternalServerError)
+			return
+		}
+
+		results := []userSummary{}
+		for _, user := range users {
+			results = append(results, publicUser(user))
+		}
+
+		response := map[string]interface{}{
+			"count": len(results),
+			"users": results,
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func getTimeline(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		_, limit, ok := pageParams(r)
+		if !ok {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		beforeID := 0
+		if token := r.URL.Query().Get("cursor"); token != "" {
+			cursor, err := decodeCursor(token)
+			if err != nil || cursor.Ascending {
+				http.Error(w, "Invalid cursor", http.StatusBadRequest)
+				return
+			}
+			beforeID = cursor.LastID
+		}
+
+		chirps, next, err := db.GetTimeline(userID, beforeID, limit)
+		if err != nil {
+			http.Error(w, "Could not retrieve timeline", http.StatusInternalServerError)
+			return
+		}
+		views, err := db.chirpViews(chirps, userID)
+		if err != nil {
+			http.Error(w, "Could not retrieve timeline", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"chirps":      views,
+			"next_cursor": nil,
+		}
+		if next != nil {
+			response["next_cursor"] = encodeCursor(*next)
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// addRelation handles blocking and muting, which only differ in the kind of relationship stored
+func addRelation(db *DB, cfg *apiConfig, relation string) http.HandlerFunc {
+	return changeRelation(cfg, func(userID, otherID int64) error {
+		return db.AddRelation(relation, userID, otherID)
+	})
+}
+
+func removeRelation(db *DB, cfg *apiConfig, relation string) http.HandlerFunc {
+	return changeRelation(cfg, func(userID, otherID int64) error {
+		return db.RemoveRelation(relation, userID, otherID)
+	})
+}
+
+func changeRelation(cfg *apiConfig, update func(userID, otherID int64) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		vars := mux.Vars(r)
+		otherID, err := strconv.ParseInt(vars["userID"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", 404)
+			return
+		}
+
+		err = update(userID, otherID)
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if errors.Is(err, errRelateSelf) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not update relationship", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(204)
+	}
+}
+
+// listRelations responds with the users the authenticated user has blocked or muted
+func listRelations(db *DB, cfg *apiConfig, relation string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		users, err := db.GetRelations(relation, userID)
+		if err != nil {
+			http.Error(w, "Could not retrieve users", http.StatusInternalServerError)
+			return
+		}
+
+		results := []userSummary{}
+		for _, user := range users {
+			results = append(results, publicUser(user))
+		}
+
+		response := map[string]interface{}{
+			"count": len(results),
+			"users": results,
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	// fanoutFollowerLimit is the follower count above which an author's chirps are no longer
+	// copied into every follower's timeline and are merged in when the timeline is read instead
+	fanoutFollowerLimit = 1000
+	// maxTimelineLength is how many chirp IDs a stored timeline keeps before dropping the oldest
+	maxTimelineLength = 800
+	// followBackfillWindow is how far back a new follow copies the followee's chirps
+	followBackfillWindow = 7 * 24 * time.Hour
+)
+
+var (
+	errUserNotFound = errors.New("user not found")
+	errFollowSelf   = errors.New("users cannot follow themselves")
+)
+
+// followerIDs returns the IDs of the users following userID
+func (dbStructure DBStructure) followerIDs(userID int64) []int64 {
+	var followers []int64
+	for followerID, following := range dbStructure.Follows {
+		if _, found := following[userID]; found {
+			followers = append(followers, followerID)
+		}
+	}
+	return followers
+}
+
+// followerCounts returns how many followers each followed user has, in a single pass
+func (dbStructure DBStructure) followerCounts() map[int64]int {
+	counts := make(map[int64]int)
+	for _, following := range dbStructure.Follows {
+		for followeeID := range following {
+			counts[followeeID]++
+		}
+	}
+	return counts
+}
+
+// fanOut pushes a new chirp into the stored timelines of its author's followers,
+// unless the author has too many followers to do that on every chirp
+func (dbStructure DBStructure) fanOut(chirp Chirp) {
+	followers := dbStructure.followerIDs(int64(chirp.Author_ID))
+	if len(followers) > fanoutFollowerLimit {
+		return
+	}
+	for _, followerID := range followers {
+		dbStructure.addToTimeline(followerID, chirp.ID)
+	}
+}
+
+// addToTimeline inserts chirp IDs into a user's stored timeline, keeping it sorted and capped
+func (dbStructure DBStructure) addToTimeline(userID int64, chirpIDs ...int) {
+	timeline := append(dbStructure.Timelines[userID], chirpIDs...)
+	sort.Ints(timeline)
+	if len(timeline) > maxTimelineLength {
+		timeline = timeline[len(timeline)-maxTimelineLength:]
+	}
+	dbStructure.Timelines[userID] = timeline
+}
+
+// Follow makes followerID follow followeeID and copies the followee's chirps from the
+// last followBackfillWindow into the follower's timeline, unless the followee has too
+// many followers to fan out to. Following someone twice has no further effect.
+func (db *DB) Follow(followerID, followeeID int64) error {
+	if followerID == followeeID {
+		return errFollowSelf
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	if _, found := dbStructure.Users[followeeID]; !found {
+		return errUserNotFound
+	}
+	if dbStructure.hasBlock(followerID, followeeID) {
+		return errBlocked
+	}
+
+	following := dbStructure.Follows[followerID]
+	if following == nil {
+		following = make(map[int64]time.Time)
+		dbStructure.Follows[followerID] = following
+	}
+	if _, found := following[followeeID]; found {
+		return nil
+	}
+	following[followeeID] = time.Now().UTC()
+	dbStructure.addNotification(followeeID, notificationFollow, followerID, 0)
+
+	// Chirps from accounts too big to fan out to are merged in when the timeline is read
+	if len(dbStructure.followerIDs(followeeID)) <= fanoutFollowerLimit {
+		since := time.Now().Add(-followBackfillWindow)
+		var backfill []int
+		for _, chirp := range dbStructure.Chirps {
+			if int64(chirp.Author_ID) == followeeID && chirp.Created_at.After(since) {
+				backfill = append(backfill, chirp.ID)
+			}
+		}
+		dbStructure.addToTimeline(followerID, backfill...)
+	}
+
+	return db.writeDB(dbStructure)
+}
+
+// Unfollow stops followerID following followeeID and clears the followee's chirps
+// from the follower's timeline
+func (db *DB) Unfollow(followerID, followeeID int64) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+	if _, found := dbStructure.Users[followeeID]; !found {
+		return errUserNotFound
+	}
+
+	following := dbStructure.Follows[followerID]
+	if _, found := following[followeeID]; !found {
+		return nil
+	}
+	delete(following, followeeID)
+	if len(following) == 0 {
+		delete(dbStructure.Follows, followerID)
+	}
+	dbStructure.removeNotification(followeeID, notificationFollow, followerID, 0)
+
+	timeline := []int{}
+	for _, chirpID := range dbStructure.Timelines[followerID] {
+		if int64(dbStructure.Chirps[chirpID].Author_ID) != followeeID {
+			timeline = append(timeline, chirpID)
+		}
+	}
+	dbStructure.Timelines[followerID] = timeline
+
+	return db.writeDB(dbStructure)
+}
+
+// GetFollowers returns the users following userID, most recent follower first
+func (db *DB) GetFollowers(userID int64) ([]User, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	if _, found := dbStructure.Users[userID]; !found {
+		return nil, errUserNotFound
+	}
+
+	followers := []User{}
+	for _, followerID := range dbStructure.followerIDs(userID) {
+		followers = append(followers, dbStructure.Users[followerID])
+	}
+	sort.Slice(followers, func(i, j int) bool {
+		return dbStructure.Follows[followers[i].ID][userID].After(dbStructure.Follows[followers[j].ID][userID])
+	})
+
+	return followers, nil
+}
+
+// GetFollowing returns the users userID follows, most recently followed first
+func (db *DB) GetFollowing(userID int64) ([]User, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	if _, found := dbStructure.Users[userID]; !found {
+		return nil, errUserNotFound
+	}
+
+	following := dbStructure.Follows[userID]
+	users := []User{}
+	for followeeID := range following {
+		users = append(users, dbStructure.Users[followeeID])
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return following[users[i].ID].After(following[users[j].ID])
+	})
+
+	return users, nil
+}
+
+// GetTimeline returns a page of chirps from the accounts userID follows, newest first,
+// starting after beforeID when it isn't 0. The returned cursor is nil on the last page.
+func (db *DB) GetTimeline(userID int64, beforeID int, limit int) ([]Chirp, *chirpCursor, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	following := dbStructure.Follows[userID]
+
+	// Stored timelines hold chirps from regular accounts, chirps from accounts
+	// with too many followers to fan out to are looked up now instead
+	candidates := append([]int{}, dbStructure.Timelines[userID]...)
+	followerCounts := dbStructure.followerCounts()
+	unfanned := make(map[int64]bool)
+	for followeeID := range following {
+		if followerCounts[followeeID] > fanoutFollowerLimit {
+			unfanned[followeeID] = true
+		}
+	}
+	if len(unfanned) > 0 {
+		for _, chirp := range dbStructure.Chirps {
+			if unfanned[int64(chirp.Author_ID)] {
+				candidates = append(candidates, chirp.ID)
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(candidates)))
+
+	chirps := []Chirp{}
+	previousID := 0
+	for _, chirpID := range candidates {
+		if chirpID == previousID || (beforeID != 0 && chirpID >= beforeID) {
+			continue
+		}
+		previousID = chirpID
+
+		// Chirps deleted or by accounts unfollowed since they were stored are skipped
+		chirp, found := dbStructure.Chirps[chirpID]
+		if !found || !dbStructure.canView(chirp, userID) {
+			continue
+		}
+		if _, follows := following[int64(chirp.Author_ID)]; !follows {
+			continue
+		}
+		if dbStructure.hasMuted(userID, int64(chirp.Author_ID)) {
+			continue
+		}
+
+		if len(chirps) == limit {
+			next := chirpCursor{LastID: chirps[len(chirps)-1].ID}
+			return chirps, &next, nil
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, nil, nil
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"sort"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -16,69 +20,184 @@ func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 
 }
 
-func getHandler(db *DB) http.HandlerFunc {
+// middlewareRejectSuspended refuses requests carrying the access token of a suspended
+// user. Requests without a valid token are left for the handlers to deal with.
+func (cfg *apiConfig) middlewareRejectSuspended(db *DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			userID, err := userIDFromRequest(r, cfg.jwtSecret)
+			if err == nil {
+				if user, err := db.GetSuspension(userID); err == nil {
+					writeSuspended(w, user)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func getHandler(db *DB, cfg *apiConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		authorId := r.URL.Query().Get("author_id")
-		sortOrder := r.URL.Query().Get("sort")
+		// Anonymous requests are allowed, they just never have liked anything
+		viewerID, _ := userIDFromRequest(r, cfg.jwtSecret)
 
-		// Step 1: Call GetChirps to fetch all chirps from the database
-		chirps, err := db.GetChirps()
+		query := r.URL.Query()
+		ascending := query.Get("sort") == "asc"
+		// Clients asking for a page get an envelope with the next cursor,
+		// everyone else keeps getting the plain list of every chirp
+		paginated := query.Has("limit") || query.Has("cursor")
+
+		filter, err := chirpFilterFromQuery(query)
 		if err != nil {
-			http.Error(w, "Could not retrieve chirps", http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		filter.viewerID = viewerID
 
-		if authorId != "" {
-			var matchedChirps []Chirp
-			for _, chirp := range chirps {
-				if fmt.Sprint(chirp.Author_ID) == authorId {
-					matchedChirps = append(matchedChirps, chirp)
+		limit := 0
+		afterID := 0
+		if paginated {
+			var ok bool
+			_, limit, ok = pageParams(r)
+			if !ok {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			if token := query.Get("cursor"); token != "" {
+				cursor, err := decodeCursor(token)
+				if err != nil || cursor.Ascending != ascending {
+					http.Error(w, "Invalid cursor", http.StatusBadRequest)
+					return
 				}
+				afterID = cursor.LastID
 			}
-			chirps = matchedChirps
+		}
 
+		// Step 1: Fetch the requested page of chirps from the database
+		chirps, next, err := db.GetChirpPage(filter, afterID, ascending, limit)
+		if err != nil {
+			http.Error(w, "Could not retrieve chirps", http.StatusInternalServerError)
+			return
 		}
 
-		if sortOrder == "asc" {
-			sort.Slice(chirps, func(i, j int) bool {
-				return chirps[i].ID < chirps[j].ID
-			})
-		} else {
-			sort.Slice(chirps, func(i, j int) bool {
-				return chirps[i].ID > chirps[j].ID
-			})
+		views, err := db.chirpViews(chirps, viewerID)
+		if err != nil {
+			http.Error(w, "Could not retrieve chirps", http.StatusInternalServerError)
+			return
 		}
 
 		// Step 2: Respond with the list of chirps in JSON format
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(chirps)
+		if !paginated {
+			json.NewEncoder(w).Encode(views)
+			return
+		}
 
+		response := map[string]interface{}{
+			"chirps":      views,
+			"next_cursor": nil,
+		}
+		if next != nil {
+			response["next_cursor"] = encodeCursor(*next)
+		}
+		json.NewEncoder(w).Encode(response)
 	}
 }
 
-func postHandler(db *DB, cfg *apiConfig) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		users, _ := db.loadDB()
-		authorID := 0
-
-		claims, _ := jwtValidate(r, cfg.jwtSecret)
+// chirpFilterFromQuery reads the author_id, since_id, max_id, since and until parameters.
+// author_id may be repeated or hold a comma-separated list.
+func chirpFilterFromQuery(query url.Values) (chirpFilter, error) {
+	filter := chirpFilter{authorIDs: make(map[int]bool)}
 
-		for _, user := range users.Users {
-			if fmt.Sprint(user.ID) == claims.Subject {
-				authorID = int(user.ID)
+	for _, value := range query["author_id"] {
+		for _, idStr := range strings.Split(value, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(idStr))
+			if err != nil {
+				return filter, fmt.Errorf("invalid author_id")
 			}
+			filter.authorIDs[id] = true
 		}
+	}
+
+	var err error
+	if sinceID := query.Get("since_id"); sinceID != "" {
+		if filter.sinceID, err = strconv.Atoi(sinceID); err != nil {
+			return filter, fmt.Errorf("invalid since_id")
+		}
+	}
+	if maxID := query.Get("max_id"); maxID != "" {
+		if filter.maxID, err = strconv.Atoi(maxID); err != nil {
+			return filter, fmt.Errorf("invalid max_id")
+		}
+	}
+	if since := query.Get("since"); since != "" {
+		if filter.since, err = parseSearchDate(since); err != nil {
+			return filter, fmt.Errorf("invalid since date")
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.until, err = parseSearchDate(until); err != nil {
+			return filter, fmt.Errorf("invalid until date")
+		}
+	}
+
+	return filter, nil
+}
+
+func postHandler(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+		entitlements, err := db.GetEntitlements(userID)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+		authorID := int(userID)
 
 		// Step 1: Read and validate the request body
-		var reqBody map[string]string
-		err := json.NewDecoder(r.Body).Decode(&reqBody)
-		if err != nil || reqBody["body"] == "" {
+		var reqBody chirpRequest
+		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
+		moderated, err := reqBody.validate(entitlements, cfg.moderation)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body, opts := moderated.Body, reqBody.options()
+		opts.HeldBy = moderated.heldBy()
+
+		// Chirps with a publish time are saved as scheduled drafts instead
+		if reqBody.Publish_at != nil {
+			draft, err := db.SaveDraft(0, body, authorID, opts, reqBody.Publish_at, entitlements.Max_scheduled_chirps)
+			if errors.Is(err, errTooManyScheduled) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			if writeChirpOptionsError(w, err) {
+				return
+			}
+			if err != nil {
+				http.Error(w, "Could not schedule chirp", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(draft)
+			return
+		}
 
 		// Step 2: Call CreateChirp with the body content
-		chirp, err := db.CreateChirp(reqBody["body"], authorID)
+		chirp, err := db.CreateChirp(body, authorID, opts)
+		if writeChirpOptionsError(w, err) {
+			return
+		}
 		if err != nil {
 			http.Error(w, "Could not create chirp", http.StatusInternalServerError)
 			return
@@ -89,3 +208,93 @@ func postHandler(db *DB, cfg *apiConfig) http.HandlerFunc {
 		json.NewEncoder(w).Encode(chirp)
 	}
 }
+
+// chirpRequest is the body of a request creating a chirp or a draft
+type chirpRequest struct {
+	Body        string `json:"body"`
+	In_reply_to int    `json:"in_reply_to"`
+	Quote_of    int    `json:"quote_of"`
+	// Attachment_IDs are uploads from POST /api/media
+	Attachment_IDs []string `json:"attachment_ids"`
+	// Publish_at schedules the chirp instead of publishing it right away
+	Publish_at *time.Time `json:"publish_at"`
+	// Ephemeral chirps set either an expiry time or how long after
+	// publication they expire
+	Expires_at         *time.Time `json:"expires_at"`
+	Expires_in_seconds int64      `json:"expires_in_seconds"`
+	// Visibility is public, followers or direct
+	Visibility string `json:"visibility"`
+}
+
+// validate checks the request against the author's entitlements and moderates its body
+func (req *chirpRequest) validate(entitlements Entitlements, moderation *moderationPipeline) (moderationResult, error) {
+	if req.Body == "" && len(req.Attachment_IDs) == 0 {
+		return moderationResult{}, errors.New("Invalid request")
+	}
+	if len(req.Attachment_IDs) > entitlements.Max_attachments {
+		return moderationResult{}, fmt.Errorf("Chirps can have at most %d attachments", entitlements.Max_attachments)
+	}
+	if req.Publish_at != nil {
+		publishAt := req.Publish_at.UTC()
+		if !publishAt.After(time.Now()) || publishAt.After(time.Now().Add(maxScheduleAhead)) {
+			return moderationResult{}, errors.New("publish_at must be in the future and within a year")
+		}
+		req.Publish_at = &publishAt
+	}
+	if req.Expires_at != nil || req.Expires_in_seconds != 0 {
+		publishedAt := time.Now().UTC()
+		if req.Publish_at != nil {
+			publishedAt = *req.Publish_at
+		}
+		expiresAt := publishedAt.Add(time.Duration(req.Expires_in_seconds) * time.Second)
+		if req.Expires_at != nil {
+			if req.Expires_in_seconds != 0 {
+				return moderationResult{}, errors.New("Set either expires_at or expires_in_seconds")
+			}
+			expiresAt = req.Expires_at.UTC()
+		}
+		ttl := expiresAt.Sub(publishedAt)
+		if ttl < minChirpTTL || ttl > maxChirpTTL {
+			return moderationResult{}, errors.New("Chirps must expire between a minute and a year after they are published")
+		}
+		req.Expires_at = &expiresAt
+	}
+	if req.Visibility != "" && !validVisibility(req.Visibility) {
+		return moderationResult{}, errInvalidVisibility
+	}
+	return validateChirpBody(req.Body, entitlements, moderation)
+}
+
+func (req chirpRequest) options() ChirpOptions {
+	return ChirpOptions{
+		InReplyTo:     req.In_reply_to,
+		QuoteOf:       req.Quote_of,
+		AttachmentIDs: req.Attachment_IDs,
+		ExpiresAt:     req.Expires_at,
+		Visibility:    req.Visibility,
+	}
+}
+
+// writeChirpOptionsError responds to the errors caused by a chirp's reply, quote or
+// attachments, or by it looking like spam, and reports whether it did
+func writeChirpOptionsError(w http.ResponseWriter, err error) bool {
+	var tooFast postingTooFastError
+	switch {
+	case errors.As(err, &tooFast):
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(tooFast.RetryAfter)))
+		http.Error(w, tooFast.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, errChirpRejected):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errChirpNotFound):
+		http.Error(w, "Chirp being replied to or quoted does not exist", http.StatusBadRequest)
+	case errors.Is(err, errBlocked):
+		http.Error(w, "Cannot reply to this chirp", http.StatusForbidden)
+	case errors.Is(err, errNotShareable):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errInvalidAttachment), errors.Is(err, errAttachmentNotReady), errors.Is(err, errExpiryPassed):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		return false
+	}
+	return true
+}
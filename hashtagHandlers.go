@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultTrendingWindow is how far back trending hashtags look when no window is given
+const defaultTrendingWindow = 24 * time.Hour
+
+func getHashtagChirps(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		viewerID, _ := userIDFromRequest(r, cfg.jwtSecret)
+
+		offset, limit, ok := pageParams(r)
+		if !ok {
+			http.Error(w, "Invalid pagination parameters", http.StatusBadRequest)
+			return
+		}
+
+		vars := mux.Vars(r)
+		chirps, hasMore, err := db.GetHashtagChirps(vars["tag"], viewerID, offset, limit)
+		if err != nil {
+			http.Error(w, "Could not retrieve chirps", http.StatusInternalServerError)
+			return
+		}
+		views, err := db.chirpViews(chirps, viewerID)
+		if err != nil {
+			http.Error(w, "Could not retrieve chirps", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"chirps": views,
+		}
+		if hasMore {
+			response["next_offset"] = offset + len(chirps)
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func getTrendingHashtags(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		window := defaultTrendingWindow
+		if windowStr := r.URL.Query().Get("window"); windowStr != "" {
+			var err error
+			window, err = time.ParseDuration(windowStr)
+			if err != nil || window <= 0 {
+				http.Error(w, "Invalid window", http.StatusBadRequest)
+				return
+			}
+		}
+		_, limit, ok := pageParams(r)
+		if !ok {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+
+		trending, err := db.TrendingHashtags(time.Now().UTC().Add(-window), limit)
+		if err != nil {
+			http.Error(w, "Could not retrieve hashtags", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(trending)
+	}
+}
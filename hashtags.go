@@ -0,0 +1,142 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// hashtagPattern matches a # that starts a word, followed by letters, digits or underscores
+var hashtagPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&#])#([\p{L}\p{N}_]+)`)
+
+type trendingHashtag struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// extractHashtags returns the distinct lowercased hashtags in a chirp body, in order of appearance
+func extractHashtags(body string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, match := range hashtagPattern.FindAllStringSubmatch(body, -1) {
+		tag := strings.ToLower(match[1])
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// indexHashtags adds a chirp to the inverted index under each of its hashtags
+func (dbStructure DBStructure) indexHashtags(chirp Chirp) {
+	for _, tag := range chirp.Hashtags {
+		ids := append(dbStructure.Hashtags[tag], chirp.ID)
+		sort.Ints(ids)
+		dbStructure.Hashtags[tag] = ids
+	}
+}
+
+// unindexHashtags removes a chirp from the inverted index
+func (dbStructure DBStructure) unindexHashtags(chirp Chirp) {
+	for _, tag := range chirp.Hashtags {
+		ids := dbStructure.Hashtags[tag]
+		for i, id := range ids {
+			if id == chirp.ID {
+				ids = append(ids[:i], ids[i+1:]...)
+				break
+			}
+		}
+		if len(ids) == 0 {
+			delete(dbStructure.Hashtags, tag)
+		} else {
+			dbStructure.Hashtags[tag] = ids
+		}
+	}
+}
+
+// rebuildHashtagIndex extracts the hashtags of every chirp and indexes them from scratch
+func (dbStructure *DBStructure) rebuildHashtagIndex() {
+	dbStructure.Hashtags = make(map[string][]int)
+	for id, chirp := range dbStructure.Chirps {
+		chirp.Hashtags = extractHashtags(chirp.Body)
+		dbStructure.Chirps[id] = chirp
+		dbStructure.indexHashtags(chirp)
+	}
+}
+
+// GetHashtagChirps returns a page of the chirps tagged with tag that viewerID may see,
+// newest first, along with whether more chirps follow the page
+func (db *DB) GetHashtagChirps(tag string, viewerID int64, offset, limit int) ([]Chirp, bool, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, false, err
+	}
+
+	ids := dbStructure.Hashtags[strings.ToLower(tag)]
+	chirps := []Chirp{}
+	skipped := 0
+	for i := len(ids) - 1; i >= 0; i-- {
+		chirp := dbStructure.Chirps[ids[i]]
+		if !dbStructure.canView(chirp, viewerID) {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		if len(chirps) == limit {
+			return chirps, true, nil
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, false, nil
+}
+
+// TrendingHashtags counts how many chirps used each hashtag since the given time
+// and returns the limit most used ones
+func (db *DB) TrendingHashtags(since time.Time, limit int) ([]trendingHashtag, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	trending := []trendingHashtag{}
+	for tag, ids := range dbStructure.Hashtags {
+		count := 0
+		// IDs grow with creation time, so walk back from the newest until the window ends
+		for i := len(ids) - 1; i >= 0; i-- {
+			chirp := dbStructure.Chirps[ids[i]]
+			if chirp.Created_at.Before(since) {
+				break
+			}
+			// Trends are public, so only public chirps count towards them
+			if dbStructure.canView(chirp, 0) {
+				count++
+			}
+		}
+		if count > 0 {
+			trending = append(trending, trendingHashtag{Tag: tag, Count: count})
+		}
+	}
+
+	sort.Slice(trending, func(i, j int) bool {
+		if trending[i].Count != trending[j].Count {
+			return trending[i].Count > trending[j].Count
+		}
+		return trending[i].Tag < trending[j].Tag
+	})
+	if len(trending) > limit {
+		trending = trending[:limit]
+	}
+
+	return trending, nil
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+const (
+	// maxImageDimension is the largest width or height accepted for uploaded images
+	maxImageDimension = 8192
+	// maxImagePixels caps width*height so small files can't decode into huge bitmaps
+	maxImagePixels = 40_000_000
+	// maxGIFFrames and maxGIFPixels cap animations, whose frames are all decoded at
+	// once: blank frames compress so well that a few MB can hold gigabytes of pixels
+	maxGIFFrames = 500
+	maxGIFPixels = 100_000_000
+	jpegQuality  = 90
+)
+
+var (
+	errImageTooLarge     = errors.New("image dimensions are too large")
+	errAnimationTooLarge = errors.New("animation is too large")
+)
+
+// thumbnailSizes maps each thumbnail name to the longest side it is scaled down to
+var thumbnailSizes = []struct {
+	Name string
+	Size int
+}{
+	{"small", 150},
+	{"medium", 600},
+	{"large", 1200},
+}
+
+// checkImageDimensions reads only the image header, so oversized images are
+// rejected before anything is decoded
+func checkImageDimensions(data []byte) (image.Config, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return image.Config{}, err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxImageDimension ||
+		config.Height > maxImageDimension || config.Width*config.Height > maxImagePixels {
+		return config, errImageTooLarge
+	}
+	if format == "gif" {
+		return config, checkGIFFrames(data)
+	}
+	return config, nil
+}
+
+// checkGIFFrames walks the blocks of a GIF without decompressing anything and
+// rejects animations with too many frames or too many pixels across all frames
+func checkGIFFrames(data []byte) error {
+	// Header and logical screen descriptor
+	if len(data) < 13 {
+		return image.ErrFormat
+	}
+	i := 13
+	if data[10]&0x80 != 0 {
+		i += 3 << (data[10]&0x07 + 1)
+	}
+
+	// skipSubBlocks returns the position after a run of data sub-blocks
+	skipSubBlocks := func(i int) (int, error) {
+		for {
+			if i >= len(data) {
+				return 0, image.ErrFormat
+			}
+			size := int(data[i])
+			i++
+			if size == 0 {
+				return i, nil
+			}
+			i += size
+		}
+	}
+
+	frames, pixels := 0, 0
+	for i < len(data) {
+		var err error
+		switch data[i] {
+		case 0x21: // Extension
+			if i+2 > len(data) {
+				return image.ErrFormat
+			}
+			i, err = skipSubBlocks(i + 2)
+		case 0x2C: // Image descriptor
+			if i+10 > len(data) {
+				return image.ErrFormat
+			}
+			width := int(binary.LittleEndian.Uint16(data[i+5:]))
+			height := int(binary.LittleEndian.Uint16(data[i+7:]))
+			frames++
+			pixels += width * height
+			if frames > maxGIFFrames || pixels > maxGIFPixels {
+				return errAnimationTooLarge
+			}
+			packed := data[i+9]
+			i += 10
+			if packed&0x80 != 0 {
+				i += 3 << (packed&0x07 + 1)
+			}
+			// Skip the LZW minimum code size, then the compressed pixels
+			i, err = skipSubBlocks(i + 1)
+		case 0x3B: // Trailer
+			return nil
+		default:
+			return image.ErrFormat
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processedImage is an upload that has been decoded and written out again
+type processedImage struct {
+	// Data is the re-encoded file. Encoding from the decoded pixels drops
+	// EXIF, GPS and any other metadata the original carried.
+	Data []byte
+	// Frame is the first frame, upright, used for thumbnails and the blurhash
+	Frame image.Image
+}
+
+// sanitizeImage decodes an uploaded PNG, JPEG or GIF and encodes it again without its metadata
+func sanitizeImage(data []byte, contentType string) (processedImage, error) {
+	if _, err := checkImageDimensions(data); err != nil {
+		return processedImage{}, err
+	}
+
+	var out bytes.Buffer
+	switch contentType {
+	case "image/jpeg":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return processedImage{}, err
+		}
+		// The orientation lives in the EXIF data we're about to drop, so apply it to the pixels
+		img = applyOrientation(img, jpegOrientation(data))
+		if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return processedImage{}, err
+		}
+		return processedImage{Data: out.Bytes(), Frame: img}, nil
+
+	case "image/png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return processedImage{}, err
+		}
+		if err := png.Encode(&out, img); err != nil {
+			return processedImage{}, err
+		}
+		return processedImage{Data: out.Bytes(), Frame: img}, nil
+
+	case "image/gif":
+		// Keep every frame so animations survive; comments and application extensions are dropped
+		animation, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return processedImage{}, err
+		}
+		if err := gif.EncodeAll(&out, animation); err != nil {
+			return processedImage{}, err
+		}
+		bounds := image.Rect(0, 0, animation.Config.Width, animation.Config.Height)
+		frame := image.NewRGBA(bounds)
+		draw.Draw(frame, animation.Image[0].Bounds(), animation.Image[0], animation.Image[0].Bounds().Min, draw.Over)
+		return processedImage{Data: out.Bytes(), Frame: frame}, nil
+	}
+	return processedImage{}, image.ErrFormat
+}
+
+// encodeThumbnail scales img down so its longest side is at most size and encodes it.
+// JPEGs stay JPEGs; everything else becomes a PNG so transparency is kept.
+func encodeThumbnail(img image.Image, size int, contentType string) ([]byte, image.Rectangle, error) {
+	bounds := img.Bounds()
+	width, height := fitWithin(bounds.Dx(), bounds.Dy(), size)
+	thumbnail := resizeImage(img, width, height)
+
+	var out bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&out, thumbnail, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&out, thumbnail)
+	}
+	return out.Bytes(), thumbnail.Bounds(), err
+}
+
+// fitWithin scales width and height down to fit in a size x size box, keeping the aspect ratio
+func fitWithin(width, height, size int) (int, int) {
+	if width <= size && height <= size {
+		return width, height
+	}
+	if width >= height {
+		return size, max(1, height*size/width)
+	}
+	return max(1, width*size/height), size
+}
+
+// resizeImage scales img to width x height by averaging the source pixels
+// that fall in each destination pixel, which looks good when shrinking
+func resizeImage(img image.Image, width, height int) *image.RGBA {
+	src := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	srcWidth, srcHeight := src.Bounds().Dx(), src.Bounds().Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, max((y+1)*srcHeight/height, y*srcHeight/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, max((x+1)*srcWidth/width, x*srcWidth/width+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(row[sx*4])
+					g += uint64(row[sx*4+1])
+					b += uint64(row[sx*4+2])
+					a += uint64(row[sx*4+3])
+					n++
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)})
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) stored in a JPEG, or 1 if there is none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 1
+		}
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			// Start of the image data, nothing more to find
+			return 1
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of a TIFF structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[offset:]))
+	for n := 0; n < entries; n++ {
+		entry := offset + 2 + n*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// applyOrientation rotates and flips img so that EXIF orientation o becomes upright
+func applyOrientation(img image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	// Orientations 5 to 8 swap the axes
+	dstWidth, dstHeight := width, height
+	if o >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch o {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -45,6 +45,20 @@ func jwtValidate(r *http.Request, secret string) (*customClaims, error) {
 	return claims, nil
 }
 
+// userIDFromRequest validates the bearer token and returns the ID of the user it was issued to
+func userIDFromRequest(r *http.Request, secret string) (int64, error) {
+	claims, err := jwtValidate(r, secret)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid token subject")
+	}
+	return id, nil
+}
+
 func jwtCreation(user User, secret string) string {
 	claims := customClaims{
 		jwt.RegisteredClaims{
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -15,6 +18,9 @@ type apiConfig struct {
 	fileserverHits int
 	jwtSecret      string
 	apiKey         string
+	blobStore      BlobStore
+	mediaProcessor *mediaProcessor
+	moderation     *moderationPipeline
 }
 
 func main() {
@@ -26,7 +32,25 @@ func main() {
 	// clears database file whenever we run program to make testing faster
 	debugCode()
 
-	apiCfg := &apiConfig{jwtSecret: jwtSecret, apiKey: apiKey}
+	mediaDir := os.Getenv("MEDIA_DIR")
+	if mediaDir == "" {
+		mediaDir = "media"
+	}
+	blobStore, err := newLocalBlobStore(mediaDir)
+	if err != nil {
+		log.Fatalf("failed to initialize media storage: %v", err)
+	}
+
+	moderation, err := loadModerationPipeline(moderationConfigPath())
+	if errors.Is(err, fs.ErrNotExist) && os.Getenv("MODERATION_CONFIG") == "" {
+		log.Printf("no moderation config found, using the default word list")
+		moderation, err = defaultModerationPipeline(), nil
+	}
+	if err != nil {
+		log.Fatalf("failed to load moderation config: %v", err)
+	}
+
+	apiCfg := &apiConfig{jwtSecret: jwtSecret, apiKey: apiKey, blobStore: blobStore, moderation: moderation}
 	r := mux.NewRouter()
 
 	//mux := http.NewServeMux()
@@ -38,8 +62,38 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to initialize database: %v", err)
 	}
+	db.spam = moderation.spam
+
+	rateLimits, err := loadRateLimitConfig(os.Getenv("RATE_LIMIT_CONFIG"))
+	if err != nil {
+		log.Fatalf("failed to load rate limit config: %v", err)
+	}
+	limiter, err := newRateLimiter(newMemoryRateLimitStore(), rateLimits)
+	if err != nil {
+		log.Fatalf("invalid rate limit config: %v", err)
+	}
+	r.Use(apiCfg.middlewareRateLimit(limiter))
+	r.Use(apiCfg.middlewareRejectSuspended(db))
+
+	apiCfg.mediaProcessor = newMediaProcessor(db, blobStore)
+	err = apiCfg.mediaProcessor.Start()
+	if err != nil {
+		log.Fatalf("failed to start media processing: %v", err)
+	}
+	newChirpScheduler(db).Start()
+
+	expiryGrace := defaultExpiryGrace
+	if grace := os.Getenv("CHIRP_EXPIRY_GRACE"); grace != "" {
+		expiryGrace, err = time.ParseDuration(grace)
+		if err != nil || expiryGrace < 0 {
+			log.Fatalf("invalid CHIRP_EXPIRY_GRACE %q", grace)
+		}
+	}
+	newChirpSweeper(db, blobStore, expiryGrace).Start()
 
 	r.Handle("/app/*", http.StripPrefix("/app", wrappedFileServer))
+	r.HandleFunc("/media/{key:.+}", serveMedia(apiCfg)).Methods("GET", "HEAD")
+	r.HandleFunc("/api/media", uploadMedia(db, apiCfg)).Methods("POST")
 
 	r.HandleFunc("GET /api/healthz", apiCfg.readyHandler)
 	r.HandleFunc("GET /admin/metrics", apiCfg.hitsHandler)
@@ -48,7 +102,7 @@ func main() {
 	r.HandleFunc("/api/chirps", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			getHandler(db).ServeHTTP(w, r)
+			getHandler(db, apiCfg).ServeHTTP(w, r)
 		case http.MethodPost:
 			postHandler(db, apiCfg).ServeHTTP(w, r)
 		default:
@@ -56,11 +110,69 @@ func main() {
 		}
 	})
 
-	r.HandleFunc("/api/chirps/{chirpID}", getChirp(db)).Methods("GET")
+	r.HandleFunc("/api/chirps/stream", streamChirps(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/chirps/{chirpID}", getChirp(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/chirps/{chirpID}", editChirp(db, apiCfg)).Methods("PUT")
 	r.HandleFunc("/api/chirps/{chirpID}", deleteChirp(db, apiCfg)).Methods("DELETE")
+	r.HandleFunc("/api/chirps/{chirpID}/history", getChirpHistory(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/chirps/{chirpID}/thread", getChirpThread(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/chirps/{chirpID}/rechirp", rechirpChirp(db, apiCfg)).Methods("POST")
+	r.HandleFunc("/api/chirps/{chirpID}/likes", likeChirp(db, apiCfg)).Methods("POST")
+	r.HandleFunc("/api/chirps/{chirpID}/likes", unlikeChirp(db, apiCfg)).Methods("DELETE")
+	r.HandleFunc("/api/chirps/{chirpID}/report", reportChirp(db, apiCfg)).Methods("POST")
+
+	r.HandleFunc("/api/moderation/queue", getModerationQueue(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/moderation/cases/{caseID}", getModerationCase(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/moderation/cases/{caseID}/claim", claimModerationCase(db, apiCfg)).Methods("POST")
+	r.HandleFunc("/api/moderation/cases/{caseID}/resolve", resolveModerationCase(db, apiCfg)).Methods("POST")
+	r.HandleFunc("/api/moderation/log", getModerationLog(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/moderation/users/{userID}/suspension", suspendUser(db, apiCfg)).Methods("POST")
+	r.HandleFunc("/api/moderation/users/{userID}/suspension", unsuspendUser(db, apiCfg)).Methods("DELETE")
+	r.HandleFunc("/api/moderation/users/{userID}/shadow-ban", shadowBanUser(db, apiCfg, true)).Methods("POST")
+	r.HandleFunc("/api/moderation/users/{userID}/shadow-ban", shadowBanUser(db, apiCfg, false)).Methods("DELETE")
+
+	r.HandleFunc("/api/drafts", getDrafts(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/drafts", saveDraft(db, apiCfg)).Methods("POST")
+	r.HandleFunc("/api/drafts/{draftID}", getDraft(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/drafts/{draftID}", saveDraft(db, apiCfg)).Methods("PUT")
+	r.HandleFunc("/api/drafts/{draftID}", deleteDraft(db, apiCfg)).Methods("DELETE")
+	r.HandleFunc("/api/drafts/{draftID}/publish", publishDraft(db, apiCfg)).Methods("POST")
+
+	r.HandleFunc("/api/search", searchHandler(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/hashtags/trending", getTrendingHashtags(db)).Methods("GET")
+	r.HandleFunc("/api/hashtags/{tag}/chirps", getHashtagChirps(db, apiCfg)).Methods("GET")
 
 	r.HandleFunc("/api/users", postUsers(db)).Methods("POST")
 	r.HandleFunc("/api/users", updateUser(db, apiCfg)).Methods("PUT")
+	r.HandleFunc("/api/users/me/profile", updateProfile(db, apiCfg)).Methods("PUT")
+	r.HandleFunc("/api/users/me/avatar", uploadAvatar(db, apiCfg)).Methods("POST")
+	r.HandleFunc("/api/users/me/entitlements", getEntitlements(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/users/{handle}", getProfile(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/users/{userID}/likes", getUserLikes(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/users/{userID}/follow", followUser(db, apiCfg)).Methods("POST")
+	r.HandleFunc("/api/users/{userID}/follow", unfollowUser(db, apiCfg)).Methods("DELETE")
+	r.HandleFunc("/api/users/{userID}/followers", getFollowers(db)).Methods("GET")
+	r.HandleFunc("/api/users/{userID}/following", getFollowing(db)).Methods("GET")
+	r.HandleFunc("/api/timeline", getTimeline(db, apiCfg)).Methods("GET")
+
+	r.HandleFunc("/api/users/{userID}/block", addRelation(db, apiCfg, relationBlock)).Methods("POST")
+	r.HandleFunc("/api/users/{userID}/block", removeRelation(db, apiCfg, relationBlock)).Methods("DELETE")
+	r.HandleFunc("/api/users/{userID}/mute", addRelation(db, apiCfg, relationMute)).Methods("POST")
+	r.HandleFunc("/api/users/{userID}/mute", removeRelation(db, apiCfg, relationMute)).Methods("DELETE")
+	r.HandleFunc("/api/blocks", listRelations(db, apiCfg, relationBlock)).Methods("GET")
+	r.HandleFunc("/api/mutes", listRelations(db, apiCfg, relationMute)).Methods("GET")
+
+	r.HandleFunc("/api/notifications", getNotifications(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/notifications/read", markNotificationsRead(db, apiCfg)).Methods("POST")
+	r.HandleFunc("/api/notifications/preferences", getNotificationPreferences(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/notifications/preferences", updateNotificationPreferences(db, apiCfg)).Methods("PUT")
+
+	r.HandleFunc("/api/conversations", getConversations(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/conversations", createConversation(db, apiCfg)).Methods("POST")
+	r.HandleFunc("/api/conversations/{conversationID}", deleteConversation(db, apiCfg)).Methods("DELETE")
+	r.HandleFunc("/api/conversations/{conversationID}/messages", getMessages(db, apiCfg)).Methods("GET")
+	r.HandleFunc("/api/conversations/{conversationID}/messages", sendMessage(db, apiCfg)).Methods("POST")
+	r.HandleFunc("/api/conversations/{conversationID}/read", markConversationRead(db, apiCfg)).Methods("POST")
 
 	r.HandleFunc("/api/login", loginUser(db, apiCfg)).Methods("POST")
 	r.HandleFunc("/api/refresh", func(w http.ResponseWriter, r *http.Request) {
@@ -82,6 +194,7 @@ func main() {
 	})
 
 	r.HandleFunc("/api/polka/webhooks", polkaHandler(db, apiCfg)).Methods("POST")
+	r.HandleFunc("/admin/users/{userID}/moderator", setModerator(db, apiCfg)).Methods("PUT")
 
 	http.Handle("/", r)
 
@@ -89,6 +202,14 @@ func main() {
 
 }
 
+// moderationConfigPath is where the moderation pipeline is configured, MODERATION_CONFIG or moderation/config.json
+func moderationConfigPath() string {
+	if path := os.Getenv("MODERATION_CONFIG"); path != "" {
+		return path
+	}
+	return "moderation/config.json"
+}
+
 func debugCode() {
 	dbg := flag.Bool("debug", false, "Enable debug mode")
 	flag.Parse()
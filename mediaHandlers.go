@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxMediaSize is the largest chirp attachment accepted
+const maxMediaSize = 5 << 20
+
+// imageExtensions lists the sniffed content types accepted for uploads and their file extensions.
+// Only formats we can decode are accepted, since every image is re-encoded to strip its metadata.
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+}
+
+// readImageUpload reads an image from a multipart form field, enforcing the size limit
+// and checking the content type from the bytes rather than trusting the client
+func readImageUpload(w http.ResponseWriter, r *http.Request, field string, maxSize int64) ([]byte, string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1024)
+	file, _, err := r.FormFile(field)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s must be an image under %dMB", field, maxSize>>20)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxSize+1))
+	if err != nil || int64(len(data)) > maxSize {
+		return nil, "", fmt.Errorf("%s must be an image under %dMB", field, maxSize>>20)
+	}
+
+	contentType := http.DetectContentType(data)
+	if _, ok := imageExtensions[contentType]; !ok {
+		return nil, "", fmt.Errorf("%s must be a PNG, JPEG or GIF image", field)
+	}
+	if _, err := checkImageDimensions(data); errors.Is(err, errAnimationTooLarge) {
+		return nil, "", fmt.Errorf("%s must be an animation of at most %d frames and %d pixels across them", field, maxGIFFrames, maxGIFPixels)
+	} else if err != nil {
+		return nil, "", fmt.Errorf("%s must be a valid image of at most %dx%d pixels", field, maxImageDimension, maxImageDimension)
+	}
+	return data, contentType, nil
+}
+
+func uploadMedia(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		data, contentType, err := readImageUpload(w, r, "file", maxMediaSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The raw upload is kept out of sight until the processor has stripped its metadata
+		id := newAttachmentID()
+		key := incomingPrefix + id
+		err = cfg.blobStore.Put(key, bytes.NewReader(data))
+		if err != nil {
+			http.Error(w, "Could not save media", http.StatusInternalServerError)
+			return
+		}
+
+		attachment, err := db.CreateAttachment(Attachment{
+			ID:           id,
+			Owner_ID:     userID,
+			Content_type: contentType,
+			Size:         int64(len(data)),
+			Blob_key:     key,
+		})
+		if err != nil {
+			cfg.blobStore.Delete(key)
+			http.Error(w, "Could not save media", http.StatusInternalServerError)
+			return
+		}
+		cfg.mediaProcessor.Enqueue(attachment)
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(attachment)
+	}
+}
+
+// serveMedia serves blobs by key. Keys are never reused for different content,
+// so responses may be cached indefinitely.
+func serveMedia(cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := mux.Vars(r)["key"]
+		if strings.HasPrefix(key, incomingPrefix) {
+			http.NotFound(w, r)
+			return
+		}
+		blob, err := cfg.blobStore.Open(key)
+		if errors.Is(err, errBlobNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not read media", http.StatusInternalServerError)
+			return
+		}
+		defer blob.Close()
+
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, key, time.Time{}, blob)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+// mediaWorkers is how many uploads are processed at the same time
+const mediaWorkers = 2
+
+// mediaProcessor turns raw uploads into sanitized images with thumbnails in the
+// background, so uploading and posting don't wait on image decoding
+type mediaProcessor struct {
+	db        *DB
+	blobStore BlobStore
+	queue     chan Attachment
+}
+
+func newMediaProcessor(db *DB, blobStore BlobStore) *mediaProcessor {
+	return &mediaProcessor{db: db, blobStore: blobStore, queue: make(chan Attachment, 64)}
+}
+
+// Start runs the workers and requeues uploads left unprocessed by a previous run
+func (p *mediaProcessor) Start() error {
+	for i := 0; i < mediaWorkers; i++ {
+		go func() {
+			for attachment := range p.queue {
+				p.process(attachment)
+			}
+		}()
+	}
+
+	pending, err := p.db.PendingAttachments()
+	if err != nil {
+		return err
+	}
+	for _, attachment := range pending {
+		p.Enqueue(attachment)
+	}
+	return nil
+}
+
+// Enqueue schedules an uploaded attachment for processing without blocking the caller
+func (p *mediaProcessor) Enqueue(attachment Attachment) {
+	go func() {
+		p.queue <- attachment
+	}()
+}
+
+func (p *mediaProcessor) process(attachment Attachment) {
+	processed, written, err := p.processImage(attachment)
+	if err != nil {
+		log.Printf("processing attachment %s failed: %v", attachment.ID, err)
+		for _, key := range written {
+			p.blobStore.Delete(key)
+		}
+		processed = attachment
+		processed.Status = attachmentFailed
+		processed.Blob_key = ""
+	}
+
+	_, err = p.db.FinishAttachment(processed)
+	if err != nil {
+		// The attachment is gone, don't leave its files behind
+		if !errors.Is(err, errInvalidAttachment) {
+			log.Printf("saving attachment %s failed: %v", attachment.ID, err)
+		}
+		for _, key := range written {
+			p.blobStore.Delete(key)
+		}
+		return
+	}
+	p.blobStore.Delete(attachment.Blob_key)
+}
+
+// processImage writes the sanitized image and its thumbnails, returning the updated
+// attachment and the keys of every blob written so they can be cleaned up
+func (p *mediaProcessor) processImage(attachment Attachment) (Attachment, []string, error) {
+	var written []string
+
+	blob, err := p.blobStore.Open(attachment.Blob_key)
+	if err != nil {
+		return attachment, written, err
+	}
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return attachment, written, err
+	}
+
+	img, err := sanitizeImage(data, attachment.Content_type)
+	if err != nil {
+		return attachment, written, err
+	}
+
+	key := "chirps/" + attachment.ID + imageExtensions[attachment.Content_type]
+	if err := p.blobStore.Put(key, bytes.NewReader(img.Data)); err != nil {
+		return attachment, written, err
+	}
+	written = append(written, key)
+
+	bounds := img.Frame.Bounds()
+	attachment.Blob_key = key
+	attachment.Size = int64(len(img.Data))
+	attachment.Width = bounds.Dx()
+	attachment.Height = bounds.Dy()
+	attachment.Blurhash = blurhash(img.Frame)
+	attachment.Status = attachmentReady
+
+	thumbnailExtension := ".png"
+	if attachment.Content_type == "image/jpeg" {
+		thumbnailExtension = ".jpg"
+	}
+	attachment.Thumbnails = nil
+	for _, size := range thumbnailSizes {
+		// Don't scale small images up
+		if bounds.Dx() <= size.Size && bounds.Dy() <= size.Size {
+			break
+		}
+
+		data, thumbnailBounds, err := encodeThumbnail(img.Frame, size.Size, attachment.Content_type)
+		if err != nil {
+			return attachment, written, err
+		}
+		thumbnailKey := fmt.Sprintf("chirps/%s-%s%s", attachment.ID, size.Name, thumbnailExtension)
+		if err := p.blobStore.Put(thumbnailKey, bytes.NewReader(data)); err != nil {
+			return attachment, written, err
+		}
+		written = append(written, thumbnailKey)
+
+		attachment.Thumbnails = append(attachment.Thumbnails, Thumbnail{
+			Name:     size.Name,
+			Width:    thumbnailBounds.Dx(),
+			Height:   thumbnailBounds.Dy(),
+			Blob_key: thumbnailKey,
+			Url:      mediaURL(thumbnailKey),
+		})
+	}
+
+	return attachment, written, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// mentionPattern matches an @ that starts a word, followed by something shaped like a handle
+var mentionPattern = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_@])(@([A-Za-z0-9_]+))`)
+
+// Mention is a user referenced by @handle in a chirp body.
+// Start and End are character offsets into the body, End exclusive.
+type Mention struct {
+	User_ID int64  `json:"user_id"`
+	Handle  string `json:"handle"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+}
+
+// resolveMentions finds the @handles in a body that belong to existing users.
+// Users with a block between them and the author can't be mentioned.
+func resolveMentions(dbStructure DBStructure, body string, authorID int64) []Mention {
+	usersByHandle := make(map[string]User)
+	for _, user := range dbStructure.Users {
+		if user.Handle != "" && !dbStructure.hasBlock(authorID, user.ID) {
+			usersByHandle[user.Handle] = user
+		}
+	}
+
+	var mentions []Mention
+	for _, match := range mentionPattern.FindAllStringSubmatchIndex(body, -1) {
+		// match[2]:match[3] is the mention including the @, match[4]:match[5] the handle alone
+		handle := strings.ToLower(body[match[4]:match[5]])
+		user, found := usersByHandle[handle]
+		if !found {
+			continue
+		}
+
+		start := utf8.RuneCountInString(body[:match[2]])
+		mentions = append(mentions, Mention{
+			User_ID: user.ID,
+			Handle:  user.Handle,
+			Start:   start,
+			End:     start + utf8.RuneCountInString(body[match[2]:match[3]]),
+		})
+	}
+	return mentions
+}
+
+// notifyMentions creates a mention notification for every user mentioned in the chirp,
+// skipping anyone in alreadyNotified so edits don't notify the same user twice
+func (dbStructure DBStructure) notifyMentions(chirp Chirp, alreadyNotified []Mention) {
+	notified := make(map[int64]bool)
+	for _, mention := range alreadyNotified {
+		notified[mention.User_ID] = true
+	}
+
+	for _, mention := range chirp.Mentions {
+		// Nobody hears about a chirp they aren't allowed to read
+		if notified[mention.User_ID] || !dbStructure.inAudience(chirp, mention.User_ID) {
+			continue
+		}
+		notified[mention.User_ID] = true
+		dbStructure.addNotification(mention.User_ID, notificationMention, int64(chirp.Author_ID), chirp.ID)
+	}
+}
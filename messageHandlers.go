@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// writeConversationError responds to the errors shared by the direct message endpoints
+// and reports whether it did
+func writeConversationError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, errConversationNotFound), errors.Is(err, errUserNotFound):
+		w.WriteHeader(404)
+	case errors.Is(err, errInvalidParticipants):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errBlocked):
+		http.Error(w, "Cannot message these users", http.StatusForbidden)
+	default:
+		return false
+	}
+	return true
+}
+
+// createConversation starts a conversation with the users in participant_ids
+func createConversation(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		var reqBody struct {
+			Participant_IDs []int64 `json:"participant_ids"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		conversation, created, err := db.CreateConversation(userID, reqBody.Participant_IDs)
+		if writeConversationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not create conversation", http.StatusInternalServerError)
+			return
+		}
+
+		status := 200
+		if created {
+			status = http.StatusCreated
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(conversation)
+	}
+}
+
+func getConversations(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		conversations, err := db.GetConversations(userID)
+		if err != nil {
+			http.Error(w, "Could not retrieve conversations", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(conversations)
+	}
+}
+
+// getMessages returns a page of a conversation's messages, newest first
+func getMessages(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		conversationID, err := strconv.Atoi(mux.Vars(r)["conversationID"])
+		if err != nil {
+			http.Error(w, "Invalid conversation ID", 404)
+			return
+		}
+		offset, limit, ok := pageParams(r)
+		if !ok {
+			http.Error(w, "Invalid pagination parameters", http.StatusBadRequest)
+			return
+		}
+
+		messages, hasMore, err := db.GetMessages(conversationID, userID, offset, limit)
+		if writeConversationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not retrieve messages", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"messages": messages,
+		}
+		if hasMore {
+			response["next_offset"] = offset + len(messages)
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// sendMessage posts a message to a conversation. Bodies go through the same
+// moderation as chirps; there is nobody to review held messages, so only masks
+// and rejections apply.
+func sendMessage(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		conversationID, err := strconv.Atoi(mux.Vars(r)["conversationID"])
+		if err != nil {
+			http.Error(w, "Invalid conversation ID", 404)
+			return
+		}
+
+		var reqBody struct {
+			Body string `json:"body"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil || strings.TrimSpace(reqBody.Body) == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(reqBody.Body) > maxMessageLength {
+			http.Error(w, "Message is too long", http.StatusBadRequest)
+			return
+		}
+		moderated := cfg.moderation.Moderate(reqBody.Body)
+		if moderated.Action == moderationReject {
+			http.Error(w, errChirpRejected.Error(), http.StatusBadRequest)
+			return
+		}
+
+		message, err := db.SendMessage(conversationID, userID, moderated.Body)
+		if writeConversationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not send message", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(message)
+	}
+}
+
+func markConversationRead(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		conversationID, err := strconv.Atoi(mux.Vars(r)["conversationID"])
+		if err != nil {
+			http.Error(w, "Invalid conversation ID", 404)
+			return
+		}
+
+		err = db.MarkConversationRead(conversationID, userID)
+		if writeConversationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not mark conversation as read", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deleteConversation removes a conversation for the requesting user only
+func deleteConversation(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		conversationID, err := strconv.Atoi(mux.Vars(r)["conversationID"])
+		if err != nil {
+			http.Error(w, "Invalid conversation ID", 404)
+			return
+		}
+
+		err = db.DeleteConversation(conversationID, userID)
+		if writeConversationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not delete conversation", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
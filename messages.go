@@ -0,0 +1,358 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	// maxConversationSize is how many people, the creator included, a conversation can have
+	maxConversationSize = 8
+	maxMessageLength    = 1000
+)
+
+var (
+	errConversationNotFound = errors.New("conversation not found")
+	errInvalidParticipants  = errors.New("conversations need between 1 and 7 other participants")
+)
+
+// Conversation is a private conversation between two or more users
+type Conversation struct {
+	ID              int       `json:"id"`
+	Participant_IDs []int64   `json:"participant_ids"`
+	Created_by      int64     `json:"created_by"`
+	Created_at      time.Time `json:"created_at"`
+	// Read_up_to maps a participant to the newest message they have read
+	Read_up_to map[int64]int `json:"read_up_to"`
+	// Cleared_up_to maps a participant to the newest message they deleted the
+	// conversation at; they no longer see it or anything before it
+	Cleared_up_to map[int64]int `json:"cleared_up_to"`
+	// Hidden_for lists participants who deleted the conversation. It comes back
+	// for them when a new message arrives.
+	Hidden_for map[int64]bool `json:"hidden_for"`
+}
+
+// Message is one message in a conversation
+type Message struct {
+	ID              int       `json:"id"`
+	Conversation_ID int       `json:"conversation_id"`
+	Sender_ID       int64     `json:"sender_id"`
+	Body            string    `json:"body"`
+	Created_at      time.Time `json:"created_at"`
+}
+
+// conversationView is a conversation as one of its participants sees it
+type conversationView struct {
+	ID           int           `json:"id"`
+	Participants []userSummary `json:"participants"`
+	Created_at   time.Time     `json:"created_at"`
+	Last_message *Message      `json:"last_message"`
+	Unread_count int           `json:"unread_count"`
+}
+
+func (conversation Conversation) hasParticipant(userID int64) bool {
+	for _, id := range conversation.Participant_IDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// canMessage reports whether a block stands between userID and anyone else in the conversation
+func (dbStructure DBStructure) canMessage(participantIDs []int64, userID int64) bool {
+	for _, id := range participantIDs {
+		if id != userID && dbStructure.hasBlock(userID, id) {
+			return false
+		}
+	}
+	return true
+}
+
+// conversationFor returns the conversation if userID takes part in it
+func (dbStructure DBStructure) conversationFor(conversationID int, userID int64) (Conversation, error) {
+	conversation, found := dbStructure.Conversations[conversationID]
+	if !found || !conversation.hasParticipant(userID) {
+		return Conversation{}, errConversationNotFound
+	}
+	return conversation, nil
+}
+
+// visibleMessages returns the messages of a conversation userID can see, oldest first.
+// Messages from before they deleted the conversation, from users they block or
+// who block them and from shadow-banned users are left out.
+func (dbStructure DBStructure) visibleMessages(conversation Conversation, userID int64) []Message {
+	messages := []Message{}
+	for _, message := range dbStructure.Messages {
+		if message.Conversation_ID != conversation.ID || message.ID <= conversation.Cleared_up_to[userID] {
+			continue
+		}
+		if message.Sender_ID != userID && (dbStructure.hasBlock(userID, message.Sender_ID) || dbStructure.isShadowBanned(message.Sender_ID)) {
+			continue
+		}
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID < messages[j].ID
+	})
+	return messages
+}
+
+func (dbStructure DBStructure) conversationView(conversation Conversation, userID int64) conversationView {
+	view := conversationView{ID: conversation.ID, Created_at: conversation.Created_at, Participants: []userSummary{}}
+	for _, id := range conversation.Participant_IDs {
+		if user, found := dbStructure.Users[id]; found {
+			view.Participants = append(view.Participants, publicUser(user))
+		}
+	}
+	messages := dbStructure.visibleMessages(conversation, userID)
+	if len(messages) > 0 {
+		last := messages[len(messages)-1]
+		view.Last_message = &last
+	}
+	for _, message := range messages {
+		if message.Sender_ID != userID && message.ID > conversation.Read_up_to[userID] {
+			view.Unread_count++
+		}
+	}
+	return view
+}
+
+// lastMessageID returns the ID of the newest message in a conversation, 0 if there is none
+func (dbStructure DBStructure) lastMessageID(conversationID int) int {
+	lastID := 0
+	for id, message := range dbStructure.Messages {
+		if message.Conversation_ID == conversationID && id > lastID {
+			lastID = id
+		}
+	}
+	return lastID
+}
+
+// CreateConversation starts a conversation between creatorID and the given users.
+// Starting a one-to-one conversation that already exists returns the existing one,
+// with created set to false.
+func (db *DB) CreateConversation(creatorID int64, participantIDs []int64) (view conversationView, created bool, err error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return conversationView{}, false, err
+	}
+
+	participants := []int64{creatorID}
+	seen := map[int64]bool{creatorID: true}
+	for _, id := range participantIDs {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if _, found := dbStructure.Users[id]; !found {
+			return conversationView{}, false, errUserNotFound
+		}
+		participants = append(participants, id)
+	}
+	if len(participants) < 2 || len(participants) > maxConversationSize {
+		return conversationView{}, false, errInvalidParticipants
+	}
+	// Nobody can be put in a conversation with someone standing on the other side of a block
+	for _, id := range participants {
+		if !dbStructure.canMessage(participants, id) {
+			return conversationView{}, false, errBlocked
+		}
+	}
+
+	if len(participants) == 2 {
+		for _, conversation := range dbStructure.Conversations {
+			if len(conversation.Participant_IDs) == 2 && conversation.hasParticipant(participants[0]) && conversation.hasParticipant(participants[1]) {
+				delete(conversation.Hidden_for, creatorID)
+				err = db.writeDB(dbStructure)
+				if err != nil {
+					return conversationView{}, false, err
+				}
+				return dbStructure.conversationView(conversation, creatorID), false, nil
+			}
+		}
+	}
+
+	newID := 1
+	for id := range dbStructure.Conversations {
+		newID = max(newID, id+1)
+	}
+	conversation := Conversation{
+		ID:              newID,
+		Participant_IDs: participants,
+		Created_by:      creatorID,
+		Created_at:      time.Now().UTC(),
+		Read_up_to:      make(map[int64]int),
+		Cleared_up_to:   make(map[int64]int),
+		Hidden_for:      make(map[int64]bool),
+	}
+	dbStructure.Conversations[newID] = conversation
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return conversationView{}, false, err
+	}
+
+	return dbStructure.conversationView(conversation, creatorID), true, nil
+}
+
+// GetConversations lists the conversations userID takes part in, most recently active first
+func (db *DB) GetConversations(userID int64) ([]conversationView, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	views := []conversationView{}
+	for _, conversation := range dbStructure.Conversations {
+		if !conversation.hasParticipant(userID) || conversation.Hidden_for[userID] {
+			continue
+		}
+		views = append(views, dbStructure.conversationView(conversation, userID))
+	}
+
+	lastActive := func(view conversationView) time.Time {
+		if view.Last_message != nil {
+			return view.Last_message.Created_at
+		}
+		return view.Created_at
+	}
+	sort.Slice(views, func(i, j int) bool {
+		return lastActive(views[i]).After(lastActive(views[j]))
+	})
+
+	return views, nil
+}
+
+// GetMessages returns a page of the messages userID can see in a conversation, newest
+// first, along with whether older messages follow the page
+func (db *DB) GetMessages(conversationID int, userID int64, offset, limit int) ([]Message, bool, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, false, err
+	}
+
+	conversation, err := dbStructure.conversationFor(conversationID, userID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	messages := dbStructure.visibleMessages(conversation, userID)
+	page := []Message{}
+	for i := len(messages) - 1 - offset; i >= 0; i-- {
+		if len(page) == limit {
+			return page, true, nil
+		}
+		page = append(page, messages[i])
+	}
+
+	return page, false, nil
+}
+
+// SendMessage adds a message from senderID to a conversation. Nobody can send
+// messages while a block stands between them and another participant.
+func (db *DB) SendMessage(conversationID int, senderID int64, body string) (Message, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Message{}, err
+	}
+
+	conversation, err := dbStructure.conversationFor(conversationID, senderID)
+	if err != nil {
+		return Message{}, err
+	}
+	if !dbStructure.canMessage(conversation.Participant_IDs, senderID) {
+		return Message{}, errBlocked
+	}
+
+	newID := 1
+	for id := range dbStructure.Messages {
+		newID = max(newID, id+1)
+	}
+	message := Message{
+		ID:              newID,
+		Conversation_ID: conversation.ID,
+		Sender_ID:       senderID,
+		Body:            body,
+		Created_at:      time.Now().UTC(),
+	}
+	dbStructure.Messages[newID] = message
+
+	// A new message brings the conversation back for everyone who deleted it,
+	// and the sender has obviously read everything up to their own message
+	for id := range conversation.Hidden_for {
+		delete(conversation.Hidden_for, id)
+	}
+	conversation.Read_up_to[senderID] = newID
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return message, nil
+}
+
+// MarkConversationRead marks every message in the conversation as read by userID
+func (db *DB) MarkConversationRead(conversationID int, userID int64) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	conversation, err := dbStructure.conversationFor(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	conversation.Read_up_to[userID] = dbStructure.lastMessageID(conversation.ID)
+
+	return db.writeDB(dbStructure)
+}
+
+// DeleteConversation deletes a conversation for userID only. The other participants
+// keep their copy; once nobody has one left, the conversation is gone for good.
+func (db *DB) DeleteConversation(conversationID int, userID int64) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	conversation, err := dbStructure.conversationFor(conversationID, userID)
+	if err != nil {
+		return err
+	}
+	lastID := dbStructure.lastMessageID(conversation.ID)
+	conversation.Cleared_up_to[userID] = lastID
+	conversation.Read_up_to[userID] = lastID
+	conversation.Hidden_for[userID] = true
+
+	if len(conversation.Hidden_for) == len(conversation.Participant_IDs) {
+		for id, message := range dbStructure.Messages {
+			if message.Conversation_ID == conversation.ID {
+				delete(dbStructure.Messages, id)
+			}
+		}
+		delete(dbStructure.Conversations, conversation.ID)
+	}
+
+	return db.writeDB(dbStructure)
+}
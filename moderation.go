@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Actions a moderation rule can take, from weakest to strongest
+const (
+	moderationAllow  = ""
+	moderationMask   = "mask"
+	moderationHold   = "hold"
+	moderationReject = "reject"
+)
+
+// moderationMaskText replaces masked words and matches
+const moderationMaskText = "****"
+
+var errChirpRejected = errors.New("chirp was rejected by moderation")
+
+var moderationStrength = map[string]int{
+	moderationAllow:  0,
+	moderationMask:   1,
+	moderationHold:   2,
+	moderationReject: 3,
+}
+
+// moderationHit is a part of a body a rule matched, as byte offsets with End exclusive
+type moderationHit struct {
+	Start, End int
+	Rule       string
+	Action     string
+}
+
+// moderationFilter is one step of the moderation pipeline
+type moderationFilter interface {
+	check(body string) []moderationHit
+}
+
+// moderationResult is what the pipeline decided about a body
+type moderationResult struct {
+	// Body is the text to store, with masked parts replaced
+	Body string
+	// Action is the strongest action any matching rule asked for
+	Action string
+	// Rules are the names of the rules that matched
+	Rules []string
+	// holdRules are the names of the matching rules that asked for the body to be held
+	holdRules []string
+}
+
+// heldBy returns the rules holding the body for review, nil if it isn't held.
+// Rules that only masked part of the body aren't among them.
+func (result moderationResult) heldBy() []string {
+	if result.Action != moderationHold {
+		return nil
+	}
+	return result.holdRules
+}
+
+// moderationPipeline runs chirp bodies through its filters in order.
+// Each filter sees the body as masked by the filters before it.
+type moderationPipeline struct {
+	filters []moderationFilter
+	// spam decides what happens to chirps that score as spam
+	spam spamPolicy
+}
+
+// Moderate runs body through every filter, stopping as soon as one rejects it
+func (pipeline *moderationPipeline) Moderate(body string) moderationResult {
+	result := moderationResult{Body: body, Action: moderationAllow}
+	for _, filter := range pipeline.filters {
+		hits := filter.check(result.Body)
+		for _, hit := range hits {
+			if moderationStrength[hit.Action] > moderationStrength[result.Action] {
+				result.Action = hit.Action
+			}
+			if !containsString(result.Rules, hit.Rule) {
+				result.Rules = append(result.Rules, hit.Rule)
+			}
+			if hit.Action == moderationHold && !containsString(result.holdRules, hit.Rule) {
+				result.holdRules = append(result.holdRules, hit.Rule)
+			}
+		}
+		if result.Action == moderationReject {
+			return result
+		}
+		result.Body = maskHits(result.Body, hits)
+	}
+	return result
+}
+
+// maskHits replaces the parts of body matched by masking rules
+func maskHits(body string, hits []moderationHit) string {
+	var out strings.Builder
+	last := 0
+	for _, hit := range hits {
+		if hit.Action != moderationMask || hit.Start < last {
+			continue
+		}
+		out.WriteString(body[last:hit.Start])
+		out.WriteString(moderationMaskText)
+		last = hit.End
+	}
+	out.WriteString(body[last:])
+	return out.String()
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// wordTokenPattern matches words, including the symbols and invisible characters
+// people use to disguise them ("sh@rbert", or "fornax" with a zero-width space inside)
+var wordTokenPattern = regexp.MustCompile(`[\p{L}\p{N}$@!|\x{00AD}\x{200B}-\x{200D}\x{FEFF}]+`)
+
+// wordListFilter matches whole words from a list, comparing them after
+// confusable characters have been normalized
+type wordListFilter struct {
+	rule   string
+	action string
+	words  map[string]bool
+}
+
+func (filter wordListFilter) check(body string) []moderationHit {
+	var hits []moderationHit
+	for _, match := range wordTokenPattern.FindAllStringIndex(body, -1) {
+		start, end := match[0], match[1]
+		token := body[start:end]
+
+		// Punctuation around a word ("Fornax!", "@kerfuffle") isn't part of it
+		trimmed := strings.TrimLeftFunc(token, isWordSymbol)
+		start += len(token) - len(trimmed)
+		trimmed = strings.TrimRightFunc(trimmed, isWordSymbol)
+		end = start + len(trimmed)
+
+		if filter.words[normalizeConfusables(trimmed)] || filter.words[normalizeConfusables(token)] {
+			hits = append(hits, moderationHit{Start: start, End: end, Rule: filter.rule, Action: filter.action})
+		}
+	}
+	return hits
+}
+
+func isWordSymbol(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+// regexFilter matches a regular expression against the body
+type regexFilter struct {
+	rule    string
+	action  string
+	pattern *regexp.Regexp
+}
+
+func (filter regexFilter) check(body string) []moderationHit {
+	var hits []moderationHit
+	for _, match := range filter.pattern.FindAllStringIndex(body, -1) {
+		hits = append(hits, moderationHit{Start: match[0], End: match[1], Rule: filter.rule, Action: filter.action})
+	}
+	return hits
+}
+
+// linkPattern finds links and bare domains; the first group is the host
+var linkPattern = regexp.MustCompile(`(?i)(?:https?://)?((?:[a-z0-9](?:[a-z0-9-]*[a-z0-9])?\.)+[a-z]{2,})(?:[:/?#][^\s]*)?`)
+
+// linkFilter matches links to blocked domains and their subdomains
+type linkFilter struct {
+	rule    string
+	action  string
+	domains map[string]bool
+}
+
+func (filter linkFilter) check(body string) []moderationHit {
+	var hits []moderationHit
+	for _, match := range linkPattern.FindAllStringSubmatchIndex(body, -1) {
+		host := strings.ToLower(body[match[2]:match[3]])
+		for {
+			if filter.domains[host] {
+				hits = append(hits, moderationHit{Start: match[0], End: match[1], Rule: filter.rule, Action: filter.action})
+				break
+			}
+			dot := strings.IndexByte(host, '.')
+			if dot < 0 {
+				break
+			}
+			host = host[dot+1:]
+		}
+	}
+	return hits
+}
+
+// confusables maps characters that look like or stand in for latin letters to those letters
+var confusables = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '5': 's', '7': 't',
+	'$': 's', '@': 'a', '!': 'i', '|': 'l',
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p',
+	'с': 'c', 'т': 't', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+	// Accented latin
+	'à': 'a', 'á': 'a', 'â': 'a', 'ã': 'a', 'ä': 'a', 'å': 'a',
+	'è': 'e', 'é': 'e', 'ê': 'e', 'ë': 'e',
+	'ì': 'i', 'í': 'i', 'î': 'i', 'ï': 'i',
+	'ò': 'o', 'ó': 'o', 'ô': 'o', 'õ': 'o', 'ö': 'o', 'ø': 'o',
+	'ù': 'u', 'ú': 'u', 'û': 'u', 'ü': 'u',
+	'ñ': 'n', 'ç': 'c', 'ý': 'y', 'ÿ': 'y',
+}
+
+// normalizeConfusables lowercases s, folds look-alike characters to latin letters
+// and drops invisible characters, so disguised words compare equal to the real ones
+func normalizeConfusables(s string) string {
+	var out strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\u00AD' || r == '\u200B' || r == '\u200C' || r == '\u200D' || r == '\uFEFF':
+			continue
+		case r >= 'Ａ' && r <= 'Ｚ':
+			r = 'a' + (r - 'Ａ')
+		case r >= 'ａ' && r <= 'ｚ':
+			r = 'a' + (r - 'ａ')
+		}
+		r = unicode.ToLower(r)
+		if replacement, found := confusables[r]; found {
+			r = replacement
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
+
+// moderationConfig is the JSON file describing the pipeline.
+// Files it names are relative to the config file.
+type moderationConfig struct {
+	Filters []struct {
+		// Type is "words", "regex" or "links"
+		Type   string `json:"type"`
+		Name   string `json:"name"`
+		Action string `json:"action"`
+		// Words and domains can be listed inline or in a file with one entry per line
+		Words   []string `json:"words"`
+		Domains []string `json:"domains"`
+		File    string   `json:"file"`
+		Pattern string   `json:"pattern"`
+	} `json:"filters"`
+	// Spam overrides the default spam policy
+	Spam *spamPolicy `json:"spam"`
+}
+
+// defaultModerationPipeline masks the words Chirpy has always masked
+func defaultModerationPipeline() *moderationPipeline {
+	return &moderationPipeline{filters: []moderationFilter{
+		wordListFilter{
+			rule:   "profanity",
+			action: moderationMask,
+			words:  map[string]bool{"kerfuffle": true, "sharbert": true, "fornax": true},
+		},
+	}, spam: defaultSpamPolicy}
+}
+
+// loadModerationPipeline builds the pipeline described by the config file at path
+func loadModerationPipeline(path string) (*moderationPipeline, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config moderationConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	pipeline := &moderationPipeline{spam: defaultSpamPolicy}
+	if config.Spam != nil {
+		if err := checkSpamPolicy(*config.Spam); err != nil {
+			return nil, err
+		}
+		pipeline.spam = *config.Spam
+	}
+	for i, rule := range config.Filters {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("%s-%d", rule.Type, i+1)
+		}
+		if _, ok := moderationStrength[rule.Action]; !ok || rule.Action == moderationAllow {
+			return nil, fmt.Errorf("rule %s: unknown action %q", rule.Name, rule.Action)
+		}
+
+		entries := append(rule.Words, rule.Domains...)
+		if rule.File != "" {
+			listed, err := readListFile(filepath.Join(filepath.Dir(path), rule.File))
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			entries = append(entries, listed...)
+		}
+
+		switch rule.Type {
+		case "words":
+			words := make(map[string]bool)
+			for _, word := range entries {
+				words[normalizeConfusables(word)] = true
+			}
+			pipeline.filters = append(pipeline.filters, wordListFilter{rule: rule.Name, action: rule.Action, words: words})
+		case "regex":
+			pattern, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			pipeline.filters = append(pipeline.filters, regexFilter{rule: rule.Name, action: rule.Action, pattern: pattern})
+		case "links":
+			domains := make(map[string]bool)
+			for _, domain := range entries {
+				domains[strings.ToLower(strings.TrimPrefix(domain, "*."))] = true
+			}
+			pipeline.filters = append(pipeline.filters, linkFilter{rule: rule.Name, action: rule.Action, domains: domains})
+		default:
+			return nil, fmt.Errorf("rule %s: unknown filter type %q", rule.Name, rule.Type)
+		}
+	}
+	return pipeline, nil
+}
+
+// readListFile reads one entry per line, skipping blank lines and # comments
+func readListFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			entries = append(entries, line)
+		}
+	}
+	return entries, scanner.Err()
+}
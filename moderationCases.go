@@ -0,0 +1,435 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Reasons a chirp can be reported for
+var reportReasons = map[string]bool{
+	"spam":           true,
+	"harassment":     true,
+	"hate":           true,
+	"violence":       true,
+	"misinformation": true,
+	"other":          true,
+}
+
+// Moderation case states
+const (
+	caseOpen     = "open"
+	caseClaimed  = "claimed"
+	caseResolved = "resolved"
+)
+
+// Ways a moderator can resolve a case
+const (
+	resolutionDismiss = "dismiss"
+	resolutionHide    = "hide"
+	resolutionSuspend = "suspend"
+)
+
+// resolutionChirpDeleted closes the cases of a chirp deleted before a moderator got to it
+const resolutionChirpDeleted = "chirp deleted"
+
+// maxReportDetailsLength caps the free text a reporter can add
+const maxReportDetailsLength = 500
+
+var (
+	errCaseNotFound    = errors.New("moderation case not found")
+	errAlreadyReported = errors.New("chirp was already reported by this user")
+	errReportOwnChirp  = errors.New("users cannot report their own chirps")
+	errCaseClaimed     = errors.New("case is claimed by another moderator")
+	errCaseNotClaimed  = errors.New("case must be claimed before it is resolved")
+	errCaseResolved    = errors.New("case is already resolved")
+	errNotModerator    = errors.New("user is not a moderator")
+	errCaseChirpGone   = errors.New("the chirp this case is about no longer exists")
+)
+
+// Report is a user flagging a chirp for moderators
+type Report struct {
+	Reporter_ID int64     `json:"reporter_id"`
+	Reason      string    `json:"reason"`
+	Details     string    `json:"details,omitempty"`
+	Created_at  time.Time `json:"created_at"`
+}
+
+// ModerationCase collects everything moderators need to decide on one chirp:
+// the reports against it and the moderation rules that held it, if any.
+// A chirp has at most one unresolved case at a time.
+type ModerationCase struct {
+	ID         int      `json:"id"`
+	Chirp_ID   int      `json:"chirp_id"`
+	Author_ID  int64    `json:"author_id"`
+	Status     string   `json:"status"`
+	Reports    []Report `json:"reports"`
+	Held_by    []string `json:"held_by,omitempty"`
+	Claimed_by int64    `json:"claimed_by,omitempty"`
+	// Resolution is one of dismiss, hide or suspend once the case is resolved,
+	// or "chirp deleted" if the chirp was deleted first
+	Resolution  string     `json:"resolution,omitempty"`
+	Note        string     `json:"note,omitempty"`
+	Resolved_by int64      `json:"resolved_by,omitempty"`
+	Resolved_at *time.Time `json:"resolved_at,omitempty"`
+	Created_at  time.Time  `json:"created_at"`
+}
+
+// ModerationLogEntry records one moderation decision. The log is never pruned,
+// not even when the chirp or case it refers to is deleted.
+type ModerationLogEntry struct {
+	ID      int `json:"id"`
+	Case_ID int `json:"case_id,omitempty"`
+	// Chirp_ID and User_ID are what the decision was about
+	Chirp_ID int   `json:"chirp_id,omitempty"`
+	User_ID  int64 `json:"user_id,omitempty"`
+	// Moderator_ID is 0 for decisions made automatically by the moderation pipeline
+	Moderator_ID int64  `json:"moderator_id"`
+	Action       string `json:"action"`
+	// Until is when a time-limited suspension ends
+	Until      *time.Time `json:"until,omitempty"`
+	Note       string     `json:"note,omitempty"`
+	Created_at time.Time  `json:"created_at"`
+}
+
+// logModeration appends a decision to the moderation log
+func (dbStructure DBStructure) logModeration(entry ModerationLogEntry) {
+	entry.ID = 1
+	for id := range dbStructure.ModerationLog {
+		if id >= entry.ID {
+			entry.ID = id + 1
+		}
+	}
+	entry.Created_at = time.Now().UTC()
+	dbStructure.ModerationLog[entry.ID] = entry
+}
+
+// openCase returns the unresolved case for a chirp, opening a new one if there is none
+func (dbStructure DBStructure) openCase(chirp Chirp) ModerationCase {
+	newID := 1
+	for id, moderationCase := range dbStructure.ModerationCases {
+		if moderationCase.Chirp_ID == chirp.ID && moderationCase.Author_ID == int64(chirp.Author_ID) && moderationCase.Status != caseResolved {
+			return moderationCase
+		}
+		if id >= newID {
+			newID = id + 1
+		}
+	}
+	return ModerationCase{
+		ID:         newID,
+		Chirp_ID:   chirp.ID,
+		Author_ID:  int64(chirp.Author_ID),
+		Status:     caseOpen,
+		Reports:    []Report{},
+		Created_at: time.Now().UTC(),
+	}
+}
+
+// holdForReview puts a chirp held by the moderation pipeline in the review queue
+func (dbStructure DBStructure) holdForReview(chirp Chirp) {
+	moderationCase := dbStructure.openCase(chirp)
+	moderationCase.Held_by = chirp.Held_by
+	dbStructure.ModerationCases[moderationCase.ID] = moderationCase
+	dbStructure.logModeration(ModerationLogEntry{
+		Case_ID:  moderationCase.ID,
+		Chirp_ID: chirp.ID,
+		User_ID:  int64(chirp.Author_ID),
+		Action:   moderationHold,
+	})
+}
+
+// closeCases resolves the unresolved cases about a chirp that is being deleted, so
+// they can't end up acting on whatever chirp comes next
+func (dbStructure DBStructure) closeCases(chirp Chirp) {
+	now := time.Now().UTC()
+	for caseID, moderationCase := range dbStructure.ModerationCases {
+		if moderationCase.Chirp_ID != chirp.ID || moderationCase.Status == caseResolved {
+			continue
+		}
+		moderationCase.Status = caseResolved
+		moderationCase.Resolution = resolutionChirpDeleted
+		moderationCase.Resolved_at = &now
+		dbStructure.ModerationCases[caseID] = moderationCase
+		dbStructure.logModeration(ModerationLogEntry{
+			Case_ID:  caseID,
+			Chirp_ID: chirp.ID,
+			User_ID:  moderationCase.Author_ID,
+			Action:   resolutionChirpDeleted,
+		})
+	}
+}
+
+// ReportChirp files a report against a chirp, adding it to the chirp's open case
+func (db *DB) ReportChirp(chirpID int, reporterID int64, reason, details string) (Report, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return Report{}, err
+	}
+
+	chirp, found := dbStructure.Chirps[chirpID]
+	if !found || !dbStructure.canView(chirp, reporterID) {
+		return Report{}, errChirpNotFound
+	}
+	if int64(chirp.Author_ID) == reporterID {
+		return Report{}, errReportOwnChirp
+	}
+
+	moderationCase := dbStructure.openCase(chirp)
+	for _, report := range moderationCase.Reports {
+		if report.Reporter_ID == reporterID {
+			return Report{}, errAlreadyReported
+		}
+	}
+	report := Report{
+		Reporter_ID: reporterID,
+		Reason:      reason,
+		Details:     details,
+		Created_at:  time.Now().UTC(),
+	}
+	moderationCase.Reports = append(moderationCase.Reports, report)
+	dbStructure.ModerationCases[moderationCase.ID] = moderationCase
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return Report{}, err
+	}
+
+	return report, nil
+}
+
+// moderationCaseView is a case together with the chirp it is about, which is nil once deleted
+type moderationCaseView struct {
+	ModerationCase
+	Chirp *Chirp `json:"chirp"`
+	// Spam_score is how spammy the chirp looked, which only moderators get to see
+	Spam_score float64 `json:"spam_score"`
+}
+
+func (dbStructure DBStructure) caseView(moderationCase ModerationCase) moderationCaseView {
+	view := moderationCaseView{ModerationCase: moderationCase}
+	if chirp, found := dbStructure.Chirps[moderationCase.Chirp_ID]; found && int64(chirp.Author_ID) == moderationCase.Author_ID {
+		view.Chirp = &chirp
+		view.Spam_score = dbStructure.SpamScores[chirp.ID]
+	}
+	return view
+}
+
+// isModerator reports whether userID can work the moderation queue
+func (dbStructure DBStructure) isModerator(userID int64) bool {
+	return dbStructure.Users[userID].Is_moderator
+}
+
+// GetModerationQueue lists the cases in the given states, oldest first
+func (db *DB) GetModerationQueue(moderatorID int64, statuses []string) ([]moderationCaseView, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	if !dbStructure.isModerator(moderatorID) {
+		return nil, errNotModerator
+	}
+
+	queue := []moderationCaseView{}
+	for _, moderationCase := range dbStructure.ModerationCases {
+		if containsString(statuses, moderationCase.Status) {
+			queue = append(queue, dbStructure.caseView(moderationCase))
+		}
+	}
+	sort.Slice(queue, func(i, j int) bool { return queue[i].ID < queue[j].ID })
+	return queue, nil
+}
+
+// GetModerationCase returns a single case
+func (db *DB) GetModerationCase(caseID int, moderatorID int64) (moderationCaseView, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return moderationCaseView{}, err
+	}
+	if !dbStructure.isModerator(moderatorID) {
+		return moderationCaseView{}, errNotModerator
+	}
+
+	moderationCase, found := dbStructure.ModerationCases[caseID]
+	if !found {
+		return moderationCaseView{}, errCaseNotFound
+	}
+	return dbStructure.caseView(moderationCase), nil
+}
+
+// ClaimCase assigns a case to a moderator so two moderators don't work on it at once.
+// Claiming a case already claimed by the same moderator is a no-op.
+func (db *DB) ClaimCase(caseID int, moderatorID int64) (moderationCaseView, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return moderationCaseView{}, err
+	}
+	if !dbStructure.isModerator(moderatorID) {
+		return moderationCaseView{}, errNotModerator
+	}
+
+	moderationCase, found := dbStructure.ModerationCases[caseID]
+	if !found {
+		return moderationCaseView{}, errCaseNotFound
+	}
+	switch {
+	case moderationCase.Status == caseResolved:
+		return moderationCaseView{}, errCaseResolved
+	case moderationCase.Status == caseClaimed && moderationCase.Claimed_by != moderatorID:
+		return moderationCaseView{}, errCaseClaimed
+	case moderationCase.Status == caseClaimed:
+		return dbStructure.caseView(moderationCase), nil
+	}
+
+	moderationCase.Status = caseClaimed
+	moderationCase.Claimed_by = moderatorID
+	dbStructure.ModerationCases[caseID] = moderationCase
+	dbStructure.logModeration(ModerationLogEntry{
+		Case_ID:      caseID,
+		Chirp_ID:     moderationCase.Chirp_ID,
+		User_ID:      moderationCase.Author_ID,
+		Moderator_ID: moderatorID,
+		Action:       "claim",
+	})
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return moderationCaseView{}, err
+	}
+
+	return dbStructure.caseView(moderationCase), nil
+}
+
+// ResolveCase closes a case claimed by moderatorID. Dismissing releases a held chirp,
+// hiding takes the chirp down and suspending also suspends its author until
+// suspendUntil, or indefinitely if it is nil.
+func (db *DB) ResolveCase(caseID int, moderatorID int64, resolution, note string, suspendUntil *time.Time) (moderationCaseView, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return moderationCaseView{}, err
+	}
+	if !dbStructure.isModerator(moderatorID) {
+		return moderationCaseView{}, errNotModerator
+	}
+
+	moderationCase, found := dbStructure.ModerationCases[caseID]
+	if !found {
+		return moderationCaseView{}, errCaseNotFound
+	}
+	switch {
+	case moderationCase.Status == caseResolved:
+		return moderationCaseView{}, errCaseResolved
+	case moderationCase.Status != caseClaimed:
+		return moderationCaseView{}, errCaseNotClaimed
+	case moderationCase.Claimed_by != moderatorID:
+		return moderationCaseView{}, errCaseClaimed
+	}
+
+	now := time.Now().UTC()
+	chirp, chirpFound := dbStructure.Chirps[moderationCase.Chirp_ID]
+	// A chirp by someone else under the same ID is not what the case is about
+	if chirpFound && int64(chirp.Author_ID) != moderationCase.Author_ID {
+		return moderationCaseView{}, errCaseChirpGone
+	}
+	switch resolution {
+	case resolutionDismiss:
+		if chirpFound && chirp.held() {
+			chirp.Held_by = nil
+			dbStructure.Chirps[chirp.ID] = chirp
+			dbStructure.emit(eventChirpCreated, chirp)
+			// Mentions were held back along with the chirp
+			dbStructure.notifyChirp(chirp)
+		}
+	case resolutionHide, resolutionSuspend:
+		if chirpFound {
+			dbStructure.emit(eventChirpDeleted, chirp)
+			chirp.Held_by = nil
+			chirp.Hidden = true
+			dbStructure.Chirps[chirp.ID] = chirp
+		}
+		if author, found := dbStructure.Users[moderationCase.Author_ID]; found && resolution == resolutionSuspend {
+			dbStructure.suspend(author, suspendUntil)
+		}
+	}
+
+	moderationCase.Status = caseResolved
+	moderationCase.Resolution = resolution
+	moderationCase.Note = note
+	moderationCase.Resolved_by = moderatorID
+	moderationCase.Resolved_at = &now
+	dbStructure.ModerationCases[caseID] = moderationCase
+	dbStructure.logModeration(ModerationLogEntry{
+		Case_ID:      caseID,
+		Chirp_ID:     moderationCase.Chirp_ID,
+		User_ID:      moderationCase.Author_ID,
+		Moderator_ID: moderatorID,
+		Action:       resolution,
+		Until:        suspendUntil,
+		Note:         note,
+	})
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return moderationCaseView{}, err
+	}
+
+	return dbStructure.caseView(moderationCase), nil
+}
+
+// GetModerationLog returns the moderation decisions about a chirp or a user, newest
+// first. Zero values don't filter.
+func (db *DB) GetModerationLog(moderatorID int64, chirpID int, userID int64) ([]ModerationLogEntry, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	if !dbStructure.isModerator(moderatorID) {
+		return nil, errNotModerator
+	}
+
+	entries := []ModerationLogEntry{}
+	for _, entry := range dbStructure.ModerationLog {
+		if (chirpID == 0 || entry.Chirp_ID == chirpID) && (userID == 0 || entry.User_ID == userID) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID > entries[j].ID })
+	return entries, nil
+}
+
+// SetModerator grants or revokes a user's moderator role
+func (db *DB) SetModerator(userID int64, isModerator bool) (User, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return User{}, err
+	}
+
+	user, found := dbStructure.Users[userID]
+	if !found {
+		return User{}, errUserNotFound
+	}
+	user.Is_moderator = isModerator
+	dbStructure.Users[userID] = user
+
+	return user, db.writeDB(dbStructure)
+}
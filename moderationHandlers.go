@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// writeModerationError responds to the errors shared by the moderation endpoints
+// and reports whether it did
+func writeModerationError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, errNotModerator):
+		w.WriteHeader(403)
+	case errors.Is(err, errCaseNotFound), errors.Is(err, errUserNotFound):
+		w.WriteHeader(404)
+	case errors.Is(err, errSanctionSelf):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errCaseClaimed), errors.Is(err, errCaseNotClaimed), errors.Is(err, errCaseResolved), errors.Is(err, errCaseChirpGone):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		return false
+	}
+	return true
+}
+
+func reportChirp(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		chirpID, err := strconv.Atoi(mux.Vars(r)["chirpID"])
+		if err != nil {
+			http.Error(w, "Invalid chirp ID", 404)
+			return
+		}
+
+		var reqBody struct {
+			Reason  string `json:"reason"`
+			Details string `json:"details"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil || !reportReasons[reqBody.Reason] {
+			http.Error(w, "Reason must be one of spam, harassment, hate, violence, misinformation or other", http.StatusBadRequest)
+			return
+		}
+		details := strings.TrimSpace(reqBody.Details)
+		if utf8.RuneCountInString(details) > maxReportDetailsLength {
+			http.Error(w, "Details are too long", http.StatusBadRequest)
+			return
+		}
+
+		report, err := db.ReportChirp(chirpID, userID, reqBody.Reason, details)
+		if errors.Is(err, errChirpNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if errors.Is(err, errReportOwnChirp) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errAlreadyReported) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not report chirp", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// getModerationQueue lists moderation cases. ?status takes a comma separated list
+// of open, claimed and resolved, defaulting to the cases still needing a decision.
+func getModerationQueue(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		statuses := []string{caseOpen, caseClaimed}
+		if status := r.URL.Query().Get("status"); status != "" {
+			statuses = strings.Split(status, ",")
+		}
+
+		queue, err := db.GetModerationQueue(userID, statuses)
+		if writeModerationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not retrieve moderation queue", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(queue)
+	}
+}
+
+func getModerationCase(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		caseID, err := strconv.Atoi(mux.Vars(r)["caseID"])
+		if err != nil {
+			http.Error(w, "Invalid case ID", 404)
+			return
+		}
+
+		moderationCase, err := db.GetModerationCase(caseID, userID)
+		if writeModerationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not retrieve moderation case", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(moderationCase)
+	}
+}
+
+func claimModerationCase(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		caseID, err := strconv.Atoi(mux.Vars(r)["caseID"])
+		if err != nil {
+			http.Error(w, "Invalid case ID", 404)
+			return
+		}
+
+		moderationCase, err := db.ClaimCase(caseID, userID)
+		if writeModerationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not claim moderation case", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(moderationCase)
+	}
+}
+
+func resolveModerationCase(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		caseID, err := strconv.Atoi(mux.Vars(r)["caseID"])
+		if err != nil {
+			http.Error(w, "Invalid case ID", 404)
+			return
+		}
+
+		var reqBody struct {
+			Action string `json:"action"`
+			Note   string `json:"note"`
+			// Duration_seconds limits a suspension, leaving it out suspends indefinitely
+			Duration_seconds int64 `json:"duration_seconds"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil || (reqBody.Action != resolutionDismiss && reqBody.Action != resolutionHide && reqBody.Action != resolutionSuspend) {
+			http.Error(w, "Action must be dismiss, hide or suspend", http.StatusBadRequest)
+			return
+		}
+		var until *time.Time
+		if reqBody.Action == resolutionSuspend {
+			until, err = suspensionEnd(reqBody.Duration_seconds)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		moderationCase, err := db.ResolveCase(caseID, userID, reqBody.Action, strings.TrimSpace(reqBody.Note), until)
+		if writeModerationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not resolve moderation case", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(moderationCase)
+	}
+}
+
+// getModerationLog returns the audit trail, optionally narrowed down with ?chirp_id= and ?user_id=
+func getModerationLog(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		query := r.URL.Query()
+		chirpID, subjectID := 0, int64(0)
+		if value := query.Get("chirp_id"); value != "" {
+			chirpID, err = strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, "Invalid chirp_id", http.StatusBadRequest)
+				return
+			}
+		}
+		if value := query.Get("user_id"); value != "" {
+			subjectID, err = strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid user_id", http.StatusBadRequest)
+				return
+			}
+		}
+
+		entries, err := db.GetModerationLog(userID, chirpID, subjectID)
+		if writeModerationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not retrieve moderation log", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(entries)
+	}
+}
+
+// writeSuspended tells a suspended user they can't use their account, and until when
+func writeSuspended(w http.ResponseWriter, user User) {
+	message := "Account suspended"
+	if user.Suspended_until != nil {
+		message += " until " + user.Suspended_until.Format(time.RFC3339)
+	}
+	http.Error(w, message, http.StatusForbidden)
+}
+
+// suspensionEnd turns a requested suspension length into its end time, nil for 0 (indefinite)
+func suspensionEnd(durationSeconds int64) (*time.Time, error) {
+	if durationSeconds < 0 {
+		return nil, errors.New("duration_seconds can't be negative")
+	}
+	if durationSeconds == 0 {
+		return nil, nil
+	}
+	until := time.Now().UTC().Add(time.Duration(durationSeconds) * time.Second)
+	return &until, nil
+}
+
+// suspendUser suspends a user, for duration_seconds or indefinitely if it is left out
+func suspendUser(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moderatorID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		userID, err := strconv.ParseInt(mux.Vars(r)["userID"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", 404)
+			return
+		}
+
+		var reqBody struct {
+			Duration_seconds int64  `json:"duration_seconds"`
+			Note             string `json:"note"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		until, err := suspensionEnd(reqBody.Duration_seconds)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		user, err := db.SuspendUser(moderatorID, userID, until, strings.TrimSpace(reqBody.Note))
+		if writeModerationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not suspend user", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(sanctionResponse(user))
+	}
+}
+
+// unsuspendUser lifts a suspension before it runs out
+func unsuspendUser(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moderatorID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		userID, err := strconv.ParseInt(mux.Vars(r)["userID"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", 404)
+			return
+		}
+
+		user, err := db.UnsuspendUser(moderatorID, userID, strings.TrimSpace(r.URL.Query().Get("note")))
+		if writeModerationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not unsuspend user", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(sanctionResponse(user))
+	}
+}
+
+// shadowBanUser shadow-bans a user, or lifts the ban when banned is false
+func shadowBanUser(db *DB, cfg *apiConfig, banned bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		moderatorID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		userID, err := strconv.ParseInt(mux.Vars(r)["userID"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", 404)
+			return
+		}
+
+		user, err := db.SetShadowBan(moderatorID, userID, banned, strings.TrimSpace(r.URL.Query().Get("note")))
+		if writeModerationError(w, err) {
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not update user", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(sanctionResponse(user))
+	}
+}
+
+// sanctionResponse is what moderators see about a user after sanctioning them
+func sanctionResponse(user User) map[string]interface{} {
+	return map[string]interface{}{
+		"id":              user.ID,
+		"suspended_at":    user.Suspended_at,
+		"suspended_until": user.Suspended_until,
+		"shadow_banned":   user.Shadow_banned,
+	}
+}
+
+// setModerator grants or revokes the moderator role. Like the Polka webhook it is
+// authenticated with the API key rather than a user's token.
+func setModerator(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keyString, found := strings.CutPrefix(r.Header.Get("Authorization"), "ApiKey ")
+		if !found || keyString != cfg.apiKey {
+			w.WriteHeader(401)
+			return
+		}
+
+		userID, err := strconv.ParseInt(mux.Vars(r)["userID"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", 404)
+			return
+		}
+
+		var reqBody struct {
+			Is_moderator bool `json:"is_moderator"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		user, err := db.SetModerator(userID, reqBody.Is_moderator)
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not update user", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"id":           user.ID,
+			"is_moderator": user.Is_moderator,
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(response)
+	}
+}
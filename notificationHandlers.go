@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// getNotifications lists the user's notifications, grouped and newest first.
+// ?unread=true leaves out read ones and ?grouped=false lists every notification on its own.
+func getNotifications(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		offset, limit, ok := pageParams(r)
+		if !ok {
+			http.Error(w, "Invalid pagination parameters", http.StatusBadRequest)
+			return
+		}
+		unreadOnly, grouped := false, true
+		if value := r.URL.Query().Get("unread"); value != "" {
+			unreadOnly, err = strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "Invalid unread filter", http.StatusBadRequest)
+				return
+			}
+		}
+		if value := r.URL.Query().Get("grouped"); value != "" {
+			grouped, err = strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "Invalid grouped flag", http.StatusBadRequest)
+				return
+			}
+		}
+
+		groups, unread, hasMore, err := db.GetNotifications(userID, unreadOnly, grouped, offset, limit)
+		if err != nil {
+			http.Error(w, "Could not retrieve notifications", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"notifications": groups,
+			"unread_count":  unread,
+		}
+		if hasMore {
+			response["next_offset"] = offset + len(groups)
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// markNotificationsRead marks the notifications in ids as read, or all of them when ids
+// is left out. An empty list marks none.
+func markNotificationsRead(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		var reqBody struct {
+			IDs *[]int `json:"ids"`
+		}
+		if r.ContentLength != 0 {
+			err = json.NewDecoder(r.Body).Decode(&reqBody)
+			if err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+
+		unread, err := db.MarkNotificationsRead(userID, reqBody.IDs)
+		if err != nil {
+			http.Error(w, "Could not mark notifications as read", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"unread_count": unread,
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func getNotificationPreferences(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		preferences, err := db.GetNotificationPreferences(userID)
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(401)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not retrieve notification preferences", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(preferences)
+	}
+}
+
+// updateNotificationPreferences turns types of notification on or off, e.g. {"like": false}
+func updateNotificationPreferences(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		var reqBody map[string]bool
+		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		preferences, err := db.SetNotificationPreferences(userID, reqBody)
+		if errors.Is(err, errUnknownNotificationType) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(401)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not update notification preferences", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(preferences)
+	}
+}
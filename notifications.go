@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	notificationMention = "mention"
+	notificationReply   = "reply"
+	notificationLike    = "like"
+	notificationFollow  = "follow"
+)
+
+// notificationTypes are the kinds of notification users can turn on and off
+var notificationTypes = []string{notificationMention, notificationReply, notificationLike, notificationFollow}
+
+// groupedNotificationTypes are grouped per chirp when listed ("3 people liked your chirp").
+// Mentions and replies each point at a different chirp, so they stay on their own.
+var groupedNotificationTypes = map[string]bool{notificationLike: true, notificationFollow: true}
+
+// maxGroupActors is how many of the people behind a notification group are listed by name
+const maxGroupActors = 3
+
+// notificationSequence names the sequence notification IDs come from. They are never
+// reused, so marking notifications read by ID can't catch newer ones.
+const notificationSequence = "notifications"
+
+var errUnknownNotificationType = errors.New("unknown notification type")
+
+// Notification tells a user that someone else did something involving them
+type Notification struct {
+	ID         int        `json:"id"`
+	User_ID    int64      `json:"user_id"`
+	Type       string     `json:"type"`
+	Actor_ID   int64      `json:"actor_id"`
+	Chirp_ID   int        `json:"chirp_id,omitempty"`
+	Created_at time.Time  `json:"created_at"`
+	Read_at    *time.Time `json:"read_at"`
+}
+
+// notificationGroup is one entry of the notifications list, standing for one
+// notification or for several of the same kind about the same chirp
+type notificationGroup struct {
+	Type     string `json:"type"`
+	Chirp_ID int    `json:"chirp_id,omitempty"`
+	// Actors are the most recent people behind the group, Actor_count all of them
+	Actors      []userSummary `json:"actors"`
+	Actor_count int           `json:"actor_count"`
+	// Summary reads like "alice and 2 others liked your chirp"
+	Summary          string    `json:"summary"`
+	Notification_IDs []int     `json:"notification_ids"`
+	Read             bool      `json:"read"`
+	Latest_at        time.Time `json:"latest_at"`
+
+	actorIDs map[int64]bool
+}
+
+// wantsNotification reports whether the user has notifications of the given type turned on.
+// Types they never set are on.
+func (user User) wantsNotification(notificationType string) bool {
+	enabled, set := user.Notification_preferences[notificationType]
+	return !set || enabled
+}
+
+// canNotify reports whether actorID is allowed to send notifications to recipientID
+func (dbStructure DBStructure) canNotify(recipientID, actorID int64) bool {
+	// Nobody gets notified about their own actions
+	if recipientID == actorID {
+		return false
+	}
+	// Sanctioned users can't reach anyone
+	if dbStructure.isSuspended(actorID) || dbStructure.isShadowBanned(actorID) {
+		return false
+	}
+	return !dbStructure.hasBlock(recipientID, actorID) && !dbStructure.hasMuted(recipientID, actorID)
+}
+
+// addNotification stores a new notification for userID, unless the recipient shouldn't hear
+// from the actor, turned that type off or was already told about the very same thing
+func (dbStructure DBStructure) addNotification(userID int64, notificationType string, actorID int64, chirpID int) {
+	if !dbStructure.canNotify(userID, actorID) || !dbStructure.Users[userID].wantsNotification(notificationType) {
+		return
+	}
+
+	for _, notification := range dbStructure.Notifications {
+		if notification.User_ID == userID && notification.Type == notificationType && notification.Actor_ID == actorID && notification.Chirp_ID == chirpID {
+			return
+		}
+	}
+
+	newID := dbStructure.nextSequenceID(notificationSequence)
+	dbStructure.Notifications[newID] = Notification{
+		ID:         newID,
+		User_ID:    userID,
+		Type:       notificationType,
+		Actor_ID:   actorID,
+		Chirp_ID:   chirpID,
+		Created_at: time.Now().UTC(),
+	}
+}
+
+// removeNotification takes back a notification when the actor undoes what caused it,
+// like unliking a chirp or unfollowing someone
+func (dbStructure DBStructure) removeNotification(userID int64, notificationType string, actorID int64, chirpID int) {
+	for id, notification := range dbStructure.Notifications {
+		if notification.User_ID == userID && notification.Type == notificationType && notification.Actor_ID == actorID && notification.Chirp_ID == chirpID {
+			delete(dbStructure.Notifications, id)
+		}
+	}
+}
+
+// pruneMentionNotifications takes back the mention notifications about an edited chirp
+// from users it no longer mentions or who can no longer read it
+func (dbStructure DBStructure) pruneMentionNotifications(chirp Chirp) {
+	mentioned := make(map[int64]bool)
+	if !chirp.held() {
+		for _, mention := range chirp.Mentions {
+			if dbStructure.inAudience(chirp, mention.User_ID) {
+				mentioned[mention.User_ID] = true
+			}
+		}
+	}
+	for id, notification := range dbStructure.Notifications {
+		if notification.Type == notificationMention && notification.Chirp_ID == chirp.ID && !mentioned[notification.User_ID] {
+			delete(dbStructure.Notifications, id)
+		}
+	}
+}
+
+// notifyChirp tells the people a newly visible chirp involves about it: the author
+// of the chirp it replies to and everyone it mentions
+func (dbStructure DBStructure) notifyChirp(chirp Chirp) {
+	var notified []Mention
+	if parent, found := dbStructure.Chirps[chirp.In_reply_to]; found && chirp.In_reply_to != 0 {
+		parentAuthorID := int64(parent.Author_ID)
+		if dbStructure.inAudience(chirp, parentAuthorID) {
+			dbStructure.addNotification(parentAuthorID, notificationReply, int64(chirp.Author_ID), chirp.ID)
+		}
+		// Mentioning the author being replied to doesn't notify them a second time
+		notified = append(notified, Mention{User_ID: parentAuthorID})
+	}
+	dbStructure.notifyMentions(chirp, notified)
+}
+
+// userNotifications returns the notifications userID may currently see, newest first
+func (dbStructure DBStructure) userNotifications(userID int64) []Notification {
+	notifications := []Notification{}
+	for _, notification := range dbStructure.Notifications {
+		if notification.User_ID == userID && dbStructure.canNotify(userID, notification.Actor_ID) {
+			notifications = append(notifications, notification)
+		}
+	}
+
+	sort.Slice(notifications, func(i, j int) bool {
+		return notifications[i].ID > notifications[j].ID
+	})
+	return notifications
+}
+
+// groupNotifications folds notifications, newest first, into the groups they are listed as.
+// Read and unread notifications are grouped separately so new activity stands out.
+func (dbStructure DBStructure) groupNotifications(notifications []Notification, grouped bool) []notificationGroup {
+	groups := []notificationGroup{}
+	index := make(map[string]int)
+	for _, notification := range notifications {
+		read := notification.Read_at != nil
+		key := fmt.Sprintf("%s/%d/%t", notification.Type, notification.Chirp_ID, read)
+		position, found := index[key]
+		if !found || !grouped || !groupedNotificationTypes[notification.Type] {
+			position = len(groups)
+			index[key] = position
+			groups = append(groups, notificationGroup{
+				Type:      notification.Type,
+				Chirp_ID:  notification.Chirp_ID,
+				Actors:    []userSummary{},
+				Read:      read,
+				Latest_at: notification.Created_at,
+				actorIDs:  make(map[int64]bool),
+			})
+		}
+
+		group := &groups[position]
+		group.Notification_IDs = append(group.Notification_IDs, notification.ID)
+		if !group.actorIDs[notification.Actor_ID] {
+			group.actorIDs[notification.Actor_ID] = true
+			group.Actor_count++
+			if actor, found := dbStructure.Users[notification.Actor_ID]; found && len(group.Actors) < maxGroupActors {
+				group.Actors = append(group.Actors, publicUser(actor))
+			}
+		}
+	}
+
+	for i := range groups {
+		groups[i].Summary = groups[i].summary()
+	}
+	return groups
+}
+
+// summary describes the group in a sentence
+func (group notificationGroup) summary() string {
+	names := []string{}
+	for _, actor := range group.Actors {
+		switch {
+		case actor.Display_name != "":
+			names = append(names, actor.Display_name)
+		case actor.Handle != "":
+			names = append(names, "@"+actor.Handle)
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, "Someone")
+	}
+	if others := group.Actor_count - len(names); others > 0 {
+		// Name two people at most when there are others to count
+		if len(names) > 2 {
+			others += len(names) - 2
+			names = names[:2]
+		}
+		noun := "others"
+		if others == 1 {
+			noun = "other"
+		}
+		names = append(names, fmt.Sprintf("%d %s", others, noun))
+	}
+
+	who := names[0]
+	if len(names) > 1 {
+		who = strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+	}
+
+	switch group.Type {
+	case notificationMention:
+		return who + " mentioned you"
+	case notificationReply:
+		return who + " replied to your chirp"
+	case notificationLike:
+		return who + " liked your chirp"
+	case notificationFollow:
+		return who + " followed you"
+	}
+	return who + " did something"
+}
+
+// GetNotifications returns a page of a user's notifications as groups, newest first,
+// along with how many notifications are unread and whether more groups follow the page.
+// unreadOnly leaves out read notifications and grouped=false lists every notification on its own.
+func (db *DB) GetNotifications(userID int64, unreadOnly, grouped bool, offset, limit int) ([]notificationGroup, int, bool, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	notifications := []Notification{}
+	unread := 0
+	for _, notification := range dbStructure.userNotifications(userID) {
+		if notification.Read_at == nil {
+			unread++
+		} else if unreadOnly {
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+
+	groups := dbStructure.groupNotifications(notifications, grouped)
+	if offset >= len(groups) {
+		return []notificationGroup{}, unread, false, nil
+	}
+	groups = groups[offset:]
+	if len(groups) > limit {
+		return groups[:limit], unread, true, nil
+	}
+	return groups, unread, false, nil
+}
+
+// MarkNotificationsRead marks the given notifications of userID as read, or all of them
+// when ids is nil, and returns how many are still unread
+func (db *DB) MarkNotificationsRead(userID int64, ids *[]int) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return 0, err
+	}
+
+	marked := make(map[int]bool)
+	if ids != nil {
+		for _, id := range *ids {
+			marked[id] = true
+		}
+	}
+
+	now := time.Now().UTC()
+	for id, notification := range dbStructure.Notifications {
+		if notification.User_ID != userID || notification.Read_at != nil {
+			continue
+		}
+		if ids == nil || marked[id] {
+			notification.Read_at = &now
+			dbStructure.Notifications[id] = notification
+		}
+	}
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return 0, err
+	}
+
+	unread := 0
+	for _, notification := range dbStructure.userNotifications(userID) {
+		if notification.Read_at == nil {
+			unread++
+		}
+	}
+	return unread, nil
+}
+
+// GetNotificationPreferences returns whether each type of notification is on for userID
+func (db *DB) GetNotificationPreferences(userID int64) (map[string]bool, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	user, found := dbStructure.Users[userID]
+	if !found {
+		return nil, errUserNotFound
+	}
+
+	return user.notificationPreferences(), nil
+}
+
+// SetNotificationPreferences turns the given types of notification on or off for userID,
+// leaving the types it doesn't mention as they were
+func (db *DB) SetNotificationPreferences(userID int64, preferences map[string]bool) (map[string]bool, error) {
+	for notificationType := range preferences {
+		if !containsString(notificationTypes, notificationType) {
+			return nil, fmt.Errorf("%w: %s", errUnknownNotificationType, notificationType)
+		}
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	user, found := dbStructure.Users[userID]
+	if !found {
+		return nil, errUserNotFound
+	}
+
+	if user.Notification_preferences == nil {
+		user.Notification_preferences = make(map[string]bool)
+	}
+	for notificationType, enabled := range preferences {
+		user.Notification_preferences[notificationType] = enabled
+	}
+	dbStructure.Users[userID] = user
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return nil, err
+	}
+
+	return user.notificationPreferences(), nil
+}
+
+func (user User) notificationPreferences() map[string]bool {
+	preferences := make(map[string]bool)
+	for _, notificationType := range notificationTypes {
+		preferences[notificationType] = user.wantsNotification(notificationType)
+	}
+	return preferences
+}
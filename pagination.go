@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// pageParams reads the limit and offset query parameters, applying defaults and caps
+func pageParams(r *http.Request) (offset, limit int, ok bool) {
+	limit = defaultPageSize
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		n, err := strconv.Atoi(limitStr)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		limit = min(n, maxPageSize)
+	}
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		n, err := strconv.Atoi(offsetStr)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		}
+		offset = n
+	}
+	return offset, limit, true
+}
+
+// chirpCursor marks where a page of chirps ended. Clients only ever see it encoded.
+type chirpCursor struct {
+	LastID    int  `json:"last_id"`
+	Ascending bool `json:"asc"`
+}
+
+func encodeCursor(cursor chirpCursor) string {
+	dat, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(dat)
+}
+
+func decodeCursor(token string) (chirpCursor, error) {
+	var cursor chirpCursor
+	dat, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, fmt.Errorf("invalid cursor")
+	}
+	if err := json.Unmarshal(dat, &cursor); err != nil || cursor.LastID <= 0 {
+		return cursor, fmt.Errorf("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// chirpFilter narrows down which chirps a page can contain. Zero values don't filter.
+type chirpFilter struct {
+	// viewerID is who the page is for, chirps they may not see are always left out
+	viewerID  int64
+	authorIDs map[int]bool
+	// sinceID and maxID bound chirp IDs, exclusive and inclusive respectively
+	sinceID int
+	maxID   int
+	since   time.Time
+	until   time.Time
+}
+
+func (filter chirpFilter) matches(chirp Chirp) bool {
+	if len(filter.authorIDs) > 0 && !filter.authorIDs[chirp.Author_ID] {
+		return false
+	}
+	if filter.sinceID != 0 && chirp.ID <= filter.sinceID {
+		return false
+	}
+	if filter.maxID != 0 && chirp.ID > filter.maxID {
+		return false
+	}
+	if !filter.since.IsZero() && chirp.Created_at.Before(filter.since) {
+		return false
+	}
+	if !filter.until.IsZero() && !chirp.Created_at.Before(filter.until) {
+		return false
+	}
+	return true
+}
+
+// GetChirpPage walks chirp IDs in order starting after afterID and collects up to
+// limit chirps matching the filter, without building the full sorted list first.
+// A limit of 0 returns every match. The returned cursor is nil on the last page.
+func (db *DB) GetChirpPage(filter chirpFilter, afterID int, ascending bool, limit int) ([]Chirp, *chirpCursor, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// IDs are handed out in increasing order, so walking them is walking creation order
+	lastID := dbStructure.Sequences[chirpSequence]
+	id, step := lastID, -1
+	if afterID != 0 {
+		id = afterID - 1
+	}
+	if ascending {
+		id, step = 1, 1
+		if afterID != 0 {
+			id = afterID + 1
+		}
+	}
+	// since_id and max_id let the walk skip whole ranges
+	if !ascending && filter.maxID != 0 && id > filter.maxID {
+		id = filter.maxID
+	}
+	if ascending && filter.sinceID != 0 && id <= filter.sinceID {
+		id = filter.sinceID + 1
+	}
+
+	chirps := []Chirp{}
+	for ; id >= 1 && id <= lastID; id += step {
+		chirp, found := dbStructure.Chirps[id]
+		if !found || !filter.matches(chirp) || !dbStructure.canView(chirp, filter.viewerID) {
+			continue
+		}
+		if limit > 0 && len(chirps) == limit {
+			// There is at least one more match, so the page needs a cursor
+			next := chirpCursor{LastID: chirps[len(chirps)-1].ID, Ascending: ascending}
+			return chirps, &next, nil
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	return chirps, nil, nil
+}
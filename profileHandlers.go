@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// maxAvatarSize is the largest avatar image accepted
+const maxAvatarSize = 2 << 20
+
+func getProfile(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		viewerID, _ := userIDFromRequest(r, cfg.jwtSecret)
+
+		vars := mux.Vars(r)
+		profile, err := db.GetProfile(vars["handle"], viewerID)
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not retrieve profile", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(profile)
+	}
+}
+
+func updateProfile(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		var reqBody profileUpdate
+		err = json.NewDecoder(r.Body).Decode(&reqBody)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		if problem := reqBody.validate(); problem != "" {
+			http.Error(w, problem, http.StatusBadRequest)
+			return
+		}
+
+		user, err := db.UpdateProfile(userID, reqBody)
+		if errors.Is(err, errHandleTaken) {
+			http.Error(w, "Handle is already taken", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(401)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not update profile", http.StatusInternalServerError)
+			return
+		}
+
+		profile, err := db.GetProfile(user.Handle, userID)
+		if err != nil {
+			// Users without a handle have no public profile yet, show them what they saved
+			profile = userProfile{userSummary: publicUser(user), Bio: user.Bio, Links: user.Links}
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(profile)
+	}
+}
+
+func uploadAvatar(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		data, contentType, err := readImageUpload(w, r, "avatar", maxAvatarSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Avatars are small enough to clean up right away
+		img, err := sanitizeImage(data, contentType)
+		if err != nil {
+			http.Error(w, "avatar must be a valid image", http.StatusBadRequest)
+			return
+		}
+
+		// A fresh key per upload means the old URL can be cached forever
+		key := fmt.Sprintf("avatars/%d-%s%s", userID, newAttachmentID(), imageExtensions[contentType])
+		err = cfg.blobStore.Put(key, bytes.NewReader(img.Data))
+		if err != nil {
+			http.Error(w, "Could not save avatar", http.StatusInternalServerError)
+			return
+		}
+
+		previous, err := db.SetAvatar(userID, mediaURL(key))
+		if err != nil {
+			cfg.blobStore.Delete(key)
+			http.Error(w, "Could not save avatar", http.StatusInternalServerError)
+			return
+		}
+		if previousKey, ok := strings.CutPrefix(previous, mediaURL("")); ok {
+			cfg.blobStore.Delete(previousKey)
+		}
+
+		response := map[string]interface{}{
+			"avatar_url": mediaURL(key),
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(response)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameLength = 50
+	maxBioLength         = 160
+	maxProfileLinks      = 4
+	maxLinkLength        = 200
+)
+
+// profileUpdate holds the profile fields a user wants to change; nil fields stay as they are
+type profileUpdate struct {
+	Handle       *string   `json:"handle"`
+	Display_name *string   `json:"display_name"`
+	Bio          *string   `json:"bio"`
+	Links        *[]string `json:"links"`
+}
+
+// validate checks the requested values against the profile limits
+func (update profileUpdate) validate() string {
+	if update.Handle != nil && !handlePattern.MatchString(*update.Handle) {
+		return "Invalid handle"
+	}
+	if update.Display_name != nil && utf8.RuneCountInString(*update.Display_name) > maxDisplayNameLength {
+		return "Display name is too long"
+	}
+	if update.Bio != nil && utf8.RuneCountInString(*update.Bio) > maxBioLength {
+		return "Bio is too long"
+	}
+	if update.Links != nil {
+		if len(*update.Links) > maxProfileLinks {
+			return "Too many links"
+		}
+		for _, link := range *update.Links {
+			parsed, err := url.Parse(link)
+			if err != nil || len(link) > maxLinkLength || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+				return "Links must be http or https URLs"
+			}
+		}
+	}
+	return ""
+}
+
+// UpdateProfile applies a profile update to a user
+func (db *DB) UpdateProfile(userID int64, update profileUpdate) (User, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return User{}, err
+	}
+	user, found := dbStructure.Users[userID]
+	if !found {
+		return User{}, errUserNotFound
+	}
+
+	if update.Handle != nil {
+		if dbStructure.handleTaken(*update.Handle, userID) {
+			return User{}, errHandleTaken
+		}
+		user.Handle = strings.ToLower(*update.Handle)
+	}
+	if update.Display_name != nil {
+		user.Display_name = strings.TrimSpace(*update.Display_name)
+	}
+	if update.Bio != nil {
+		user.Bio = strings.TrimSpace(*update.Bio)
+	}
+	if update.Links != nil {
+		user.Links = *update.Links
+	}
+	dbStructure.Users[userID] = user
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// SetAvatar points a user's avatar at a new URL and returns the URL it replaced
+func (db *DB) SetAvatar(userID int64, avatarURL string) (string, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return "", err
+	}
+	user, found := dbStructure.Users[userID]
+	if !found {
+		return "", errUserNotFound
+	}
+
+	previous := user.Avatar_url
+	user.Avatar_url = avatarURL
+	dbStructure.Users[userID] = user
+
+	return previous, db.writeDB(dbStructure)
+}
+
+// userProfile is everything shown on a user's public profile page
+type userProfile struct {
+	userSummary
+	Bio             string   `json:"bio"`
+	Links           []string `json:"links"`
+	Followers_count int      `json:"followers_count"`
+	Following_count int      `json:"following_count"`
+	Chirp_count     int      `json:"chirp_count"`
+}
+
+// GetProfile looks a user up by handle and builds their public profile as viewerID sees it
+func (db *DB) GetProfile(handle string, viewerID int64) (userProfile, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return userProfile{}, err
+	}
+
+	handle = strings.ToLower(strings.TrimPrefix(handle, "@"))
+	for _, user := range dbStructure.Users {
+		if user.Handle == "" || user.Handle != handle {
+			continue
+		}
+		if viewerID != 0 && dbStructure.hasBlock(viewerID, user.ID) {
+			break
+		}
+
+		chirpCount := 0
+		for _, chirp := range dbStructure.Chirps {
+			if int64(chirp.Author_ID) == user.ID && dbStructure.canView(chirp, viewerID) {
+				chirpCount++
+			}
+		}
+		links := user.Links
+		if links == nil {
+			links = []string{}
+		}
+
+		return userProfile{
+			userSummary:     publicUser(user),
+			Bio:             user.Bio,
+			Links:           links,
+			Followers_count: len(dbStructure.followerIDs(user.ID)),
+			Following_count: len(dbStructure.Follows[user.ID]),
+			Chirp_count:     chirpCount,
+		}, nil
+	}
+
+	return userProfile{}, errUserNotFound
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// rateLimitIdle is how long a full bucket sits unused before the memory store forgets it
+const rateLimitIdle = 10 * time.Minute
+
+// rateLimit allows Requests requests per Per_seconds, refilling continuously.
+// Requests is also the burst a client can make after being idle.
+type rateLimit struct {
+	Requests    int `json:"requests"`
+	Per_seconds int `json:"per_seconds"`
+}
+
+// refillEvery is how long the bucket takes to earn back one token
+func (limit rateLimit) refillEvery() time.Duration {
+	return time.Duration(limit.Per_seconds) * time.Second / time.Duration(limit.Requests)
+}
+
+// rateLimitResult is the state of a bucket after a request tried to take a token from it
+type rateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+	// Retry_after is how long until the next token, for rejected requests
+	Retry_after time.Duration
+}
+
+// rateLimitStore keeps the token buckets. The memory store only limits a single
+// instance; a store shared between instances can be swapped in behind this interface.
+type rateLimitStore interface {
+	Take(key string, limit rateLimit, now time.Time) rateLimitResult
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// memoryRateLimitStore keeps token buckets in memory
+type memoryRateLimitStore struct {
+	mux       sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: make(map[string]*tokenBucket)}
+}
+
+func (store *memoryRateLimitStore) Take(key string, limit rateLimit, now time.Time) rateLimitResult {
+	store.mux.Lock()
+	defer store.mux.Unlock()
+
+	if now.Sub(store.lastPrune) > rateLimitIdle {
+		store.prune(now)
+	}
+
+	capacity := float64(limit.Requests)
+	bucket, found := store.buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: capacity, last: now}
+		store.buckets[key] = bucket
+	}
+
+	refill := limit.refillEvery()
+	bucket.tokens = math.Min(capacity, bucket.tokens+float64(now.Sub(bucket.last))/float64(refill))
+	bucket.last = now
+
+	result := rateLimitResult{Limit: limit.Requests}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		result.Allowed = true
+	} else {
+		result.Retry_after = time.Duration((1 - bucket.tokens) * float64(refill))
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = time.Duration((capacity - bucket.tokens) * float64(refill))
+	return result
+}
+
+// prune forgets buckets nobody has used for a while. They would have refilled
+// completely by now, so forgetting them changes nothing for their clients.
+func (store *memoryRateLimitStore) prune(now time.Time) {
+	for key, bucket := range store.buckets {
+		if now.Sub(bucket.last) > rateLimitIdle {
+			delete(store.buckets, key)
+		}
+	}
+	store.lastPrune = now
+}
+
+// rateLimitConfig is the JSON file configuring rate limits
+type rateLimitConfig struct {
+	// Default applies to every route without a limit of its own
+	Default rateLimit `json:"default"`
+	// Routes maps "METHOD /route/template" to its limit, e.g. "POST /api/chirps"
+	// or "GET /api/chirps/{chirpID}"
+	Routes map[string]rateLimit `json:"routes"`
+	// Trusted_proxies are the addresses and CIDR ranges whose X-Forwarded-For
+	// and X-Real-IP headers are believed
+	Trusted_proxies []string `json:"trusted_proxies"`
+}
+
+var defaultRateLimitConfig = rateLimitConfig{
+	Default: rateLimit{Requests: 120, Per_seconds: 60},
+	Routes: map[string]rateLimit{
+		"POST /api/login":   {Requests: 5, Per_seconds: 60},
+		"POST /api/users":   {Requests: 5, Per_seconds: 3600},
+		"POST /api/refresh": {Requests: 10, Per_seconds: 60},
+		"POST /api/chirps":  {Requests: 10, Per_seconds: 60},
+		"POST /api/media":   {Requests: 10, Per_seconds: 60},
+
+		"POST /api/conversations/{conversationID}/messages": {Requests: 30, Per_seconds: 60},
+	},
+	Trusted_proxies: []string{"127.0.0.1/32", "::1/128"},
+}
+
+// rateLimiter throttles requests per route, keyed by the authenticated user or the client's IP
+type rateLimiter struct {
+	store          rateLimitStore
+	defaultLimit   rateLimit
+	routes         map[string]rateLimit
+	trustedProxies []*net.IPNet
+}
+
+func newRateLimiter(store rateLimitStore, config rateLimitConfig) (*rateLimiter, error) {
+	limiter := &rateLimiter{store: store, defaultLimit: config.Default, routes: config.Routes}
+	limits := map[string]rateLimit{"default": config.Default}
+	for route, limit := range config.Routes {
+		limits[route] = limit
+	}
+	for route, limit := range limits {
+		if limit.Requests <= 0 || limit.Per_seconds <= 0 {
+			return nil, fmt.Errorf("rate limit %s: requests and per_seconds must be positive", route)
+		}
+	}
+
+	for _, proxy := range config.Trusted_proxies {
+		if !strings.Contains(proxy, "/") {
+			if strings.Contains(proxy, ":") {
+				proxy += "/128"
+			} else {
+				proxy += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %w", proxy, err)
+		}
+		limiter.trustedProxies = append(limiter.trustedProxies, network)
+	}
+	return limiter, nil
+}
+
+// loadRateLimitConfig reads the rate limit config at path, falling back to the
+// defaults when no path is given. Routes listed in the file replace the default ones.
+func loadRateLimitConfig(path string) (rateLimitConfig, error) {
+	if path == "" {
+		return defaultRateLimitConfig, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return rateLimitConfig{}, err
+	}
+	config := defaultRateLimitConfig
+	config.Routes = nil
+	if err := json.Unmarshal(data, &config); err != nil {
+		return rateLimitConfig{}, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// limitFor returns the limit of the route a request matched and the name its buckets go by
+func (limiter *rateLimiter) limitFor(r *http.Request) (string, rateLimit) {
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			name := r.Method + " " + template
+			if limit, found := limiter.routes[name]; found {
+				return name, limit
+			}
+		}
+	}
+	return "default", limiter.defaultLimit
+}
+
+// clientIP works out the address of the client, believing forwarding headers
+// only when they were set by a trusted proxy
+func (limiter *rateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !limiter.trusted(host) {
+		return host
+	}
+
+	// Walk X-Forwarded-For from the nearest hop back, stopping at the first
+	// address that isn't one of our proxies
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			host = hop
+			if !limiter.trusted(hop) {
+				return hop
+			}
+		}
+		return host
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return host
+}
+
+func (limiter *rateLimiter) trusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range limiter.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// middlewareRateLimit takes a token from the bucket of the route and client for every
+// request, answering 429 once it runs dry. Signed in users are limited per user,
+// everyone else per IP.
+func (cfg *apiConfig) middlewareRateLimit(limiter *rateLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name, limit := limiter.limitFor(r)
+			client := "ip:" + limiter.clientIP(r)
+			if userID, err := userIDFromRequest(r, cfg.jwtSecret); err == nil {
+				client = "user:" + strconv.FormatInt(userID, 10)
+			}
+
+			result := limiter.store.Take(name+"|"+client, limit, time.Now())
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+			if !result.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.Retry_after)))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ceilSeconds rounds a duration up to whole seconds for headers that count in seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
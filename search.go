@@ -0,0 +1,424 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// searchQuery is a parsed search string
+type searchQuery struct {
+	// terms and phrases must all match; every phrase is a list of stemmed terms in order
+	terms   []string
+	phrases [][]string
+	// prefixes are matched against the unstemmed words, since a typed prefix can
+	// be longer than the stem of the word it is the start of
+	prefixes []string
+	authorID int64
+	author   string
+	since    time.Time
+	until    time.Time
+	hasMedia bool
+	hashtags []string
+	// words are the unstemmed free-text words, used to match user handles
+	words []string
+}
+
+// searchResult is a chirp that matched a query along with its relevance
+type searchResult struct {
+	chirp Chirp
+	score float64
+}
+
+// tokenize splits text into lowercased words made of letters, digits and underscores
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '_'
+	})
+}
+
+// stem strips common English suffixes so that e.g. "chirps", "chirped" and "chirping" match.
+// It is a small subset of the Porter stemmer, which is plenty for short chirps.
+func stem(word string) string {
+	if len(word) <= 3 {
+		return word
+	}
+
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		word = strings.TrimSuffix(word, "es")
+	case strings.HasSuffix(word, "ies"):
+		word = strings.TrimSuffix(word, "ies") + "y"
+	case strings.HasSuffix(word, "ss"), strings.HasSuffix(word, "us"):
+	case strings.HasSuffix(word, "s"):
+		word = strings.TrimSuffix(word, "s")
+	}
+
+	for _, suffix := range []string{"ingly", "edly", "ing", "ed", "ly"} {
+		base := strings.TrimSuffix(word, suffix)
+		if base != word && len(base) >= 3 && strings.ContainsAny(base, "aeiouy") {
+			word = base
+			// "hopping" -> "hopp" -> "hop"
+			if n := len(word); word[n-1] == word[n-2] && !strings.ContainsRune("lsz", rune(word[n-1])) {
+				word = word[:n-1]
+			}
+			break
+		}
+	}
+	return word
+}
+
+// indexChirpText adds the words of a chirp's body to the full-text index
+func (dbStructure DBStructure) indexChirpText(chirp Chirp) {
+	for position, word := range tokenize(chirp.Body) {
+		term := stem(word)
+		postings := dbStructure.SearchIndex[term]
+		if postings == nil {
+			postings = make(map[int][]int)
+			dbStructure.SearchIndex[term] = postings
+		}
+		postings[chirp.ID] = append(postings[chirp.ID], position)
+
+		counts := dbStructure.SearchWords[word]
+		if counts == nil {
+			counts = make(map[int]int)
+			dbStructure.SearchWords[word] = counts
+		}
+		counts[chirp.ID]++
+	}
+}
+
+// unindexChirpText removes a chirp's words from the full-text index
+func (dbStructure DBStructure) unindexChirpText(chirp Chirp) {
+	for _, word := range tokenize(chirp.Body) {
+		term := stem(word)
+		postings := dbStructure.SearchIndex[term]
+		delete(postings, chirp.ID)
+		if len(postings) == 0 {
+			delete(dbStructure.SearchIndex, term)
+		}
+
+		counts := dbStructure.SearchWords[word]
+		delete(counts, chirp.ID)
+		if len(counts) == 0 {
+			delete(dbStructure.SearchWords, word)
+		}
+	}
+}
+
+// rebuildSearchIndex indexes the text of every chirp from scratch
+func (dbStructure *DBStructure) rebuildSearchIndex() {
+	dbStructure.SearchIndex = make(map[string]map[int][]int)
+	dbStructure.SearchWords = make(map[string]map[int]int)
+	for _, chirp := range dbStructure.Chirps {
+		dbStructure.indexChirpText(chirp)
+	}
+}
+
+// parseSearchQuery understands plain words, "quoted phrases", prefix* matches and
+// the filters author:, from:, since:, until:, has:media, hashtag: and #tag
+func parseSearchQuery(q string) (searchQuery, error) {
+	var query searchQuery
+
+	// Pull out quoted phrases first so their words aren't treated as separate terms
+	parts := strings.Split(q, `"`)
+	if len(parts)%2 == 0 {
+		return query, fmt.Errorf("unterminated phrase")
+	}
+	var rest []string
+	for i, part := range parts {
+		if i%2 == 0 {
+			rest = append(rest, part)
+			continue
+		}
+		var phrase []string
+		for _, word := range tokenize(part) {
+			phrase = append(phrase, stem(word))
+		}
+		if len(phrase) == 1 {
+			query.terms = append(query.terms, phrase[0])
+		} else if len(phrase) > 1 {
+			query.phrases = append(query.phrases, phrase)
+		}
+	}
+
+	for _, field := range strings.Fields(strings.Join(rest, " ")) {
+		key, value, isFilter := strings.Cut(field, ":")
+		if isFilter && value != "" {
+			switch strings.ToLower(key) {
+			case "author", "from":
+				if id, err := strconv.ParseInt(value, 10, 64); err == nil {
+					query.authorID = id
+				} else {
+					query.author = strings.ToLower(strings.TrimPrefix(value, "@"))
+				}
+				continue
+			case "since", "until":
+				date, err := parseSearchDate(value)
+				if err != nil {
+					return query, fmt.Errorf("invalid %s date", key)
+				}
+				if strings.ToLower(key) == "since" {
+					query.since = date
+				} else {
+					query.until = date
+				}
+				continue
+			case "has":
+				if strings.ToLower(value) != "media" {
+					return query, fmt.Errorf("unknown filter has:%s", value)
+				}
+				query.hasMedia = true
+				continue
+			case "hashtag":
+				query.hashtags = append(query.hashtags, strings.ToLower(strings.TrimPrefix(value, "#")))
+				continue
+			}
+		}
+
+		if strings.HasPrefix(field, "#") && len(field) > 1 {
+			query.hashtags = append(query.hashtags, strings.ToLower(field[1:]))
+			continue
+		}
+		if strings.HasSuffix(field, "*") {
+			words := tokenize(strings.TrimSuffix(field, "*"))
+			if len(words) == 1 {
+				query.prefixes = append(query.prefixes, words[0])
+				query.words = append(query.words, words[0])
+				continue
+			}
+		}
+		for _, word := range tokenize(field) {
+			query.terms = append(query.terms, stem(word))
+			query.words = append(query.words, word)
+		}
+	}
+
+	return query, nil
+}
+
+// parseSearchDate accepts either a plain date or a full RFC 3339 timestamp
+func parseSearchDate(value string) (time.Time, error) {
+	if date, err := time.Parse("2006-01-02", value); err == nil {
+		return date, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// isEmpty reports whether the query has nothing to search or filter on
+func (query searchQuery) isEmpty() bool {
+	return len(query.terms) == 0 && len(query.phrases) == 0 && len(query.prefixes) == 0 &&
+		query.authorID == 0 && query.author == "" && query.since.IsZero() && query.until.IsZero() &&
+		!query.hasMedia && len(query.hashtags) == 0
+}
+
+// hasMedia reports whether a chirp carries any attachments
+func hasMedia(chirp Chirp) bool {
+	return len(chirp.Attachment_IDs) > 0
+}
+
+// SearchChirps returns the chirps matching the query that viewerID may see, most relevant first
+func (db *DB) SearchChirps(query searchQuery, viewerID int64) ([]Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	totalChirps := float64(len(dbStructure.Chirps))
+	idf := func(term string) float64 {
+		return math.Log(1 + totalChirps/float64(1+len(dbStructure.SearchIndex[term])))
+	}
+
+	// Every text clause narrows the candidates down to the chirps that also match it
+	var candidates map[int]float64
+	narrow := func(matches map[int]float64) {
+		if candidates == nil {
+			candidates = matches
+			return
+		}
+		for id, score := range candidates {
+			if extra, found := matches[id]; found {
+				candidates[id] = score + extra
+			} else {
+				delete(candidates, id)
+			}
+		}
+	}
+
+	for _, term := range query.terms {
+		matches := make(map[int]float64)
+		for id, positions := range dbStructure.SearchIndex[term] {
+			matches[id] = float64(len(positions)) * idf(term)
+		}
+		narrow(matches)
+	}
+
+	for _, prefix := range query.prefixes {
+		matches := make(map[int]float64)
+		for word, counts := range dbStructure.SearchWords {
+			if !strings.HasPrefix(word, prefix) {
+				continue
+			}
+			for id, count := range counts {
+				matches[id] += float64(count) * idf(stem(word))
+			}
+		}
+		narrow(matches)
+	}
+
+	for _, phrase := range query.phrases {
+		matches := make(map[int]float64)
+		for id, positions := range dbStructure.SearchIndex[phrase[0]] {
+			count := 0
+			for _, start := range positions {
+				if phraseAt(dbStructure, id, phrase, start) {
+					count++
+				}
+			}
+			if count > 0 {
+				// Phrases are worth more than their words found apart
+				var weight float64
+				for _, term := range phrase {
+					weight += idf(term)
+				}
+				matches[id] = 2 * float64(count) * weight
+			}
+		}
+		narrow(matches)
+	}
+
+	if candidates == nil {
+		// Filters only, every chirp is a candidate
+		candidates = make(map[int]float64)
+		for id := range dbStructure.Chirps {
+			candidates[id] = 0
+		}
+	}
+
+	authorID := query.authorID
+	if query.author != "" {
+		authorID = -1
+		for _, user := range dbStructure.Users {
+			if user.Handle == query.author {
+				authorID = user.ID
+			}
+		}
+	}
+
+	var results []searchResult
+	for id, score := range candidates {
+		chirp, found := dbStructure.Chirps[id]
+		if !found || !dbStructure.canView(chirp, viewerID) {
+			continue
+		}
+		if authorID != 0 && int64(chirp.Author_ID) != authorID {
+			continue
+		}
+		if !query.since.IsZero() && chirp.Created_at.Before(query.since) {
+			continue
+		}
+		if !query.until.IsZero() && !chirp.Created_at.Before(query.until) {
+			continue
+		}
+		if query.hasMedia && !hasMedia(chirp) {
+			continue
+		}
+		if !hasAllHashtags(chirp, query.hashtags) {
+			continue
+		}
+		results = append(results, searchResult{chirp: chirp, score: score})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		// Equally relevant chirps show the newest first
+		return results[i].chirp.ID > results[j].chirp.ID
+	})
+
+	chirps := make([]Chirp, 0, len(results))
+	for _, result := range results {
+		chirps = append(chirps, result.chirp)
+	}
+	return chirps, nil
+}
+
+// phraseAt reports whether the phrase appears in a chirp starting at the given word position
+func phraseAt(dbStructure DBStructure, chirpID int, phrase []string, start int) bool {
+	for offset, term := range phrase[1:] {
+		found := false
+		for _, position := range dbStructure.SearchIndex[term][chirpID] {
+			if position == start+offset+1 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func hasAllHashtags(chirp Chirp, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, chirpTag := range chirp.Hashtags {
+			if chirpTag == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// SearchUsers returns the users whose handle starts with any of the given words,
+// leaving out suspended users, anyone with a block between them and viewerID and
+// shadow-banned users other than viewerID themselves
+func (db *DB) SearchUsers(words []string, viewerID int64) ([]User, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+	for _, user := range dbStructure.Users {
+		if user.Handle == "" || (viewerID != 0 && dbStructure.hasBlock(viewerID, user.ID)) {
+			continue
+		}
+		if dbStructure.isSuspended(user.ID) || (dbStructure.isShadowBanned(user.ID) && user.ID != viewerID) {
+			continue
+		}
+		for _, word := range words {
+			if strings.HasPrefix(user.Handle, word) {
+				users = append(users, user)
+				break
+			}
+		}
+	}
+
+	// Shorter handles are closer matches, so exact matches come first
+	sort.Slice(users, func(i, j int) bool {
+		if len(users[i].Handle) != len(users[j].Handle) {
+			return len(users[i].Handle) < len(users[j].Handle)
+		}
+		return users[i].Handle < users[j].Handle
+	})
+
+	return users, nil
+}
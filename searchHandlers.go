@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func searchHandler(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		viewerID, _ := userIDFromRequest(r, cfg.jwtSecret)
+
+		query, err := parseSearchQuery(r.URL.Query().Get("q"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if query.isEmpty() {
+			http.Error(w, "Search query is required", http.StatusBadRequest)
+			return
+		}
+		offset, limit, ok := pageParams(r)
+		if !ok {
+			http.Error(w, "Invalid pagination parameters", http.StatusBadRequest)
+			return
+		}
+
+		chirps, err := db.SearchChirps(query, viewerID)
+		if err != nil {
+			http.Error(w, "Could not search chirps", http.StatusInternalServerError)
+			return
+		}
+		total := len(chirps)
+		chirps = chirps[min(offset, total):min(offset+limit, total)]
+
+		views, err := db.chirpViews(chirps, viewerID)
+		if err != nil {
+			http.Error(w, "Could not search chirps", http.StatusInternalServerError)
+			return
+		}
+
+		users, err := db.SearchUsers(query.words, viewerID)
+		if err != nil {
+			http.Error(w, "Could not search users", http.StatusInternalServerError)
+			return
+		}
+		// Only public profile fields are returned, never emails or password hashes
+		userResults := []userSummary{}
+		for _, user := range users {
+			userResults = append(userResults, publicUser(user))
+		}
+
+		response := map[string]interface{}{
+			"chirps": views,
+			"users":  userResults,
+			"total":  total,
+		}
+		if offset+limit < total {
+			response["next_offset"] = offset + limit
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+	}
+}
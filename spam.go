@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/bits"
+	"strings"
+	"time"
+)
+
+// Actions the spam policy can take on top of the moderation actions
+const spamRateLimit = "rate_limit"
+
+// spamRule is the rule name recorded when a chirp is held for looking like spam
+const spamRule = "spam"
+
+const (
+	// spamOwnWindow is how far back a chirp is compared against its author's chirps,
+	// spamGlobalWindow how far back against everyone else's
+	spamOwnWindow    = 24 * time.Hour
+	spamGlobalWindow = time.Hour
+	// spamVelocityWindow is the window posting velocity is measured over and
+	// spamVelocityLimit the number of chirps in it that counts as flooding
+	spamVelocityWindow = 10 * time.Minute
+	spamVelocityLimit  = 10
+	// Accounts younger than spamNewAccountAge look more suspicious the younger they are
+	spamNewAccountAge = 24 * time.Hour
+	// Bodies whose simhashes differ in at most simhashNearBits bits are near-duplicates
+	simhashNearBits = 3
+	// Seeing spamDuplicateLimit near-duplicates maxes out the duplicate signal
+	spamDuplicateLimit = 3
+	// Other authors' chirps only count as duplicates once spamSharedAuthors of them
+	// posted the body, and only for bodies of at least spamSharedMinWords words.
+	// Short stock phrases like "good morning" are said by everyone.
+	spamSharedAuthors  = 3
+	spamSharedMinWords = 5
+)
+
+// spamWeights is how much each signal contributes to the spam score. They add up to 1.
+var spamWeights = map[string]float64{
+	"duplicates":  0.45,
+	"velocity":    0.25,
+	"links":       0.15,
+	"account_age": 0.15,
+}
+
+// spamPolicy holds the score thresholds at which chirps are rate limited, held
+// for review or rejected. A threshold of 0 turns that action off.
+type spamPolicy struct {
+	Rate_limit float64 `json:"rate_limit"`
+	Hold       float64 `json:"hold"`
+	Reject     float64 `json:"reject"`
+	// Cooldown_seconds is how long a rate limited author has to wait between chirps
+	Cooldown_seconds int `json:"cooldown_seconds"`
+}
+
+var defaultSpamPolicy = spamPolicy{Rate_limit: 0.5, Hold: 0.7, Reject: 0.9, Cooldown_seconds: 60}
+
+// postingTooFastError turns away a chirp whose author has to wait before posting again
+type postingTooFastError struct {
+	RetryAfter time.Duration
+}
+
+func (err postingTooFastError) Error() string {
+	return "You are posting too fast, try again later"
+}
+
+// spamVerdict is what the spam policy decided about a new chirp
+type spamVerdict struct {
+	// Score is between 0 (clean) and 1 (certainly spam)
+	Score   float64
+	Signals map[string]float64
+	Action  string
+	// Retry_after is how long a rate limited author has to wait
+	Retry_after time.Duration
+}
+
+// decide applies the policy's thresholds to a score. lastChirp is when the author
+// last posted, used to work out how long a rate limit still lasts.
+func (policy spamPolicy) decide(verdict spamVerdict, lastChirp time.Time, now time.Time) spamVerdict {
+	reached := func(threshold float64) bool { return threshold > 0 && verdict.Score >= threshold }
+	switch {
+	case reached(policy.Reject):
+		verdict.Action = moderationReject
+	case reached(policy.Hold):
+		verdict.Action = moderationHold
+	case reached(policy.Rate_limit):
+		cooldown := time.Duration(policy.Cooldown_seconds) * time.Second
+		if wait := lastChirp.Add(cooldown).Sub(now); wait > 0 {
+			verdict.Action = spamRateLimit
+			verdict.Retry_after = wait
+		}
+	}
+	return verdict
+}
+
+// screenSpam scores a chirp userID is about to publish, or the new body of the chirp
+// being edited, and turns it away when the policy says so. It returns the score and
+// heldBy with the spam rule added when the policy holds the chirp for review.
+// Scoring runs under the same lock as the write that follows, so a burst of
+// identical chirps sees each one as a duplicate of the ones before it.
+func (dbStructure DBStructure) screenSpam(userID int, body string, editing int, heldBy []string, policy spamPolicy) (float64, []string, error) {
+	verdict := dbStructure.scoreSpam(userID, body, editing, policy)
+	switch verdict.Action {
+	case moderationReject:
+		return 0, nil, errChirpRejected
+	case spamRateLimit:
+		// Edits don't add to a flood, so only new chirps are slowed down
+		if editing == 0 {
+			return 0, nil, postingTooFastError{RetryAfter: verdict.Retry_after}
+		}
+	case moderationHold:
+		heldBy = append(heldBy, spamRule)
+	}
+	return verdict.Score, heldBy, nil
+}
+
+// scoreSpam scores a body userID is about to publish and decides what to do with it.
+// editing is the ID of the chirp being edited, 0 for new chirps, so that an edit
+// isn't compared with the chirp it replaces.
+func (dbStructure DBStructure) scoreSpam(userID int, body string, editing int, policy spamPolicy) spamVerdict {
+	now := time.Now().UTC()
+	fingerprint := simhash(body)
+
+	compareShared := len(strings.Fields(body)) >= spamSharedMinWords
+	sharedBy := make(map[int]bool)
+	var duplicates, recent int
+	var lastChirp time.Time
+	for _, chirp := range dbStructure.Chirps {
+		if chirp.ID == editing {
+			continue
+		}
+		own := chirp.Author_ID == userID
+		age := now.Sub(chirp.Created_at)
+		if own && chirp.Created_at.After(lastChirp) {
+			lastChirp = chirp.Created_at
+		}
+		if own && age <= spamVelocityWindow {
+			recent++
+		}
+		// Plain rechirps repeat their original's body on purpose
+		if chirp.Body == "" || (own && age > spamOwnWindow) || (!own && (!compareShared || age > spamGlobalWindow)) {
+			continue
+		}
+		if bits.OnesCount64(fingerprint^simhash(chirp.Body)) > simhashNearBits {
+			continue
+		}
+		if own {
+			duplicates++
+		} else {
+			sharedBy[chirp.Author_ID] = true
+		}
+	}
+	if len(sharedBy) >= spamSharedAuthors {
+		duplicates += len(sharedBy)
+	}
+
+	signals := map[string]float64{
+		"duplicates": min(1, float64(duplicates)/spamDuplicateLimit),
+		"velocity":   min(1, float64(recent)/spamVelocityLimit),
+		"links":      linkDensity(body),
+	}
+	// Users from before account creation times were recorded count as established
+	if author := dbStructure.Users[int64(userID)]; !author.Created_at.IsZero() {
+		signals["account_age"] = max(0, 1-float64(now.Sub(author.Created_at))/float64(spamNewAccountAge))
+	}
+
+	verdict := spamVerdict{Signals: signals}
+	for signal, value := range signals {
+		verdict.Score += spamWeights[signal] * value
+	}
+	return policy.decide(verdict, lastChirp, now)
+}
+
+// linkDensity scores how much of a body is links, reaching 1 once half its words are links
+func linkDensity(body string) float64 {
+	words := len(strings.Fields(body))
+	if words == 0 {
+		return 0
+	}
+	links := len(linkPattern.FindAllStringIndex(body, -1))
+	return min(1, 2*float64(links)/float64(words))
+}
+
+// shingles splits a body into overlapping runs of three normalized words,
+// or a single shingle for bodies shorter than that
+func shingles(body string) []string {
+	words := strings.Fields(normalizeConfusables(body))
+	for i, word := range words {
+		words[i] = strings.TrimFunc(word, isWordSymbol)
+	}
+	if len(words) < 3 {
+		return []string{strings.Join(words, " ")}
+	}
+	out := make([]string, 0, len(words)-2)
+	for i := 0; i+3 <= len(words); i++ {
+		out = append(out, strings.Join(words[i:i+3], " "))
+	}
+	return out
+}
+
+// simhash fingerprints a body so that similar bodies get fingerprints
+// differing in only a few bits
+func simhash(body string) uint64 {
+	var weights [64]int
+	for _, shingle := range shingles(body) {
+		hash := fnv.New64a()
+		hash.Write([]byte(shingle))
+		sum := hash.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+
+	var fingerprint uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			fingerprint |= 1 << bit
+		}
+	}
+	return fingerprint
+}
+
+// checkSpamPolicy reports thresholds that are out of range or out of order
+func checkSpamPolicy(policy spamPolicy) error {
+	thresholds := []float64{policy.Rate_limit, policy.Hold, policy.Reject}
+	previous := 0.0
+	for _, threshold := range thresholds {
+		if threshold < 0 || threshold > 1 {
+			return errors.New("spam thresholds must be between 0 and 1")
+		}
+		if threshold != 0 && threshold < previous {
+			return errors.New("spam thresholds must go rate_limit <= hold <= reject")
+		}
+		previous = max(previous, threshold)
+	}
+	if policy.Cooldown_seconds < 0 {
+		return errors.New("spam cooldown_seconds can't be negative")
+	}
+	return nil
+}
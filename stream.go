@@ -0,0 +1,190 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Types of events streamed to clients. Clients should treat created and updated
+// alike and upsert the chirp, since a chirp released from moderation is new to
+// everyone but its author.
+const (
+	eventChirpCreated = "chirp.created"
+	eventChirpUpdated = "chirp.updated"
+	eventChirpDeleted = "chirp.deleted"
+)
+
+const (
+	// streamBacklog is how many recent events are kept for clients resuming with Last-Event-ID
+	streamBacklog = 1000
+	// streamBuffer is how many events can queue up for a client before it counts as too
+	// slow and is disconnected; it resumes from the backlog when it reconnects
+	streamBuffer = 64
+)
+
+// chirpEvent is a change to a chirp
+type chirpEvent struct {
+	ID    int64
+	Type  string
+	Chirp Chirp
+}
+
+// visibleTo reports whether viewerID, 0 being an anonymous client, may hear about the
+// event. It is worked out from the state of the database when the event is delivered,
+// for the connected clients only.
+func (event chirpEvent) visibleTo(dbStructure DBStructure, viewerID int64) bool {
+	chirp := event.Chirp
+	authorID := int64(chirp.Author_ID)
+	if event.Type != eventChirpDeleted {
+		return dbStructure.canView(chirp, viewerID)
+	}
+
+	// Whoever may have seen a chirp should hear that it is gone, even once it has
+	// expired or its author was suspended, so only who it was meant for counts
+	if viewerID != authorID && (chirp.held() || chirp.Hidden || dbStructure.isShadowBanned(authorID)) {
+		return false
+	}
+	if viewerID != 0 && dbStructure.hasBlock(viewerID, authorID) {
+		return false
+	}
+	return dbStructure.inAudience(chirp, viewerID)
+}
+
+// emit records a change to a chirp. Events are streamed once the change has been
+// written to disk, so they must be emitted with the chirp in the state its audience
+// should be worked out from: before it is deleted or hidden, after it is created or
+// updated.
+func (dbStructure DBStructure) emit(eventType string, chirp Chirp) {
+	if dbStructure.events == nil {
+		return
+	}
+	*dbStructure.events = append(*dbStructure.events, chirpEvent{Type: eventType, Chirp: chirp})
+}
+
+// streamFilter picks the events a client wants
+type streamFilter struct {
+	viewerID int64
+	// authorID narrows the stream down to one author's chirps, 0 for everyone's
+	authorID int64
+	// timeline narrows the stream down to the viewer's home timeline: their own
+	// chirps and those of the people they follow
+	timeline bool
+}
+
+func (filter streamFilter) matches(event chirpEvent, dbStructure DBStructure) bool {
+	authorID := int64(event.Chirp.Author_ID)
+	if filter.authorID != 0 && authorID != filter.authorID {
+		return false
+	}
+	if filter.timeline && authorID != filter.viewerID {
+		if _, follows := dbStructure.Follows[filter.viewerID][authorID]; !follows {
+			return false
+		}
+	}
+	return event.visibleTo(dbStructure, filter.viewerID)
+}
+
+// streamSubscriber is one connected client. Its channel is closed when the client
+// falls too far behind.
+type streamSubscriber struct {
+	filter streamFilter
+	events chan chirpEvent
+}
+
+// chirpStream fans chirp events out to connected clients
+type chirpStream struct {
+	mux         sync.Mutex
+	nextID      int64
+	backlog     []chirpEvent
+	subscribers map[*streamSubscriber]bool
+}
+
+func newChirpStream() *chirpStream {
+	return &chirpStream{
+		// Event IDs start from the current time so they keep growing across restarts,
+		// which lets clients from before a restart tell they missed events
+		nextID:      time.Now().UnixMilli(),
+		subscribers: make(map[*streamSubscriber]bool),
+	}
+}
+
+// publish numbers the events, keeps them for resuming clients and hands them to
+// every subscriber that wants them and may see them in dbStructure, the state just
+// written. Subscribers whose buffer is full are dropped rather than holding everyone
+// else up.
+func (stream *chirpStream) publish(events []chirpEvent, dbStructure DBStructure) {
+	stream.mux.Lock()
+	defer stream.mux.Unlock()
+
+	for _, event := range events {
+		event.ID = stream.nextID
+		stream.nextID++
+		stream.backlog = append(stream.backlog, event)
+		if len(stream.backlog) > streamBacklog {
+			stream.backlog = stream.backlog[len(stream.backlog)-streamBacklog:]
+		}
+
+		for subscriber := range stream.subscribers {
+			if !subscriber.filter.matches(event, dbStructure) {
+				continue
+			}
+			select {
+			case subscriber.events <- event:
+			default:
+				delete(stream.subscribers, subscriber)
+				close(subscriber.events)
+			}
+		}
+	}
+}
+
+// subscribe registers a client. A client resuming after lastEventID gets the events
+// it missed that it may see in dbStructure; missed reports whether some of them are
+// no longer in the backlog, in which case the client has to refetch what it shows.
+func (stream *chirpStream) subscribe(filter streamFilter, lastEventID int64, dbStructure DBStructure) (subscriber *streamSubscriber, replay []chirpEvent, missed bool) {
+	stream.mux.Lock()
+	defer stream.mux.Unlock()
+
+	if lastEventID > 0 {
+		oldest := stream.nextID
+		if len(stream.backlog) > 0 {
+			oldest = stream.backlog[0].ID
+		}
+		missed = lastEventID+1 < oldest || lastEventID >= stream.nextID
+		for _, event := range stream.backlog {
+			if event.ID > lastEventID && filter.matches(event, dbStructure) {
+				replay = append(replay, event)
+			}
+		}
+	}
+
+	subscriber = &streamSubscriber{filter: filter, events: make(chan chirpEvent, streamBuffer)}
+	stream.subscribers[subscriber] = true
+	return subscriber, replay, missed
+}
+
+func (stream *chirpStream) unsubscribe(subscriber *streamSubscriber) {
+	stream.mux.Lock()
+	defer stream.mux.Unlock()
+
+	if stream.subscribers[subscriber] {
+		delete(stream.subscribers, subscriber)
+		close(subscriber.events)
+	}
+}
+
+// SubscribeChirps registers a stream client, replaying the events it missed as the
+// current state of the database allows it to see them. Holding the lock means no
+// change can be published between the replay and the subscription.
+func (db *DB) SubscribeChirps(filter streamFilter, lastEventID int64) (*streamSubscriber, []chirpEvent, bool, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	subscriber, replay, missed := db.stream.subscribe(filter, lastEventID, dbStructure)
+	return subscriber, replay, missed, nil
+}
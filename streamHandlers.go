@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// streamHeartbeat is how often an idle stream sends a comment to keep proxies
+	// from closing the connection
+	streamHeartbeat = 15 * time.Second
+	// streamWriteTimeout is how long a write to a client may take before it is
+	// considered gone
+	streamWriteTimeout = 10 * time.Second
+	// streamRetry is how long clients are told to wait before reconnecting, in milliseconds
+	streamRetry = 3000
+)
+
+// streamChirps streams new, edited and deleted chirps as Server-Sent Events.
+// ?author_id= narrows the stream down to one author and ?timeline=true to the
+// signed in user's home timeline. Clients resume with the Last-Event-ID header
+// or ?last_event_id=; a "reset" event tells them events were missed and they
+// should refetch.
+func streamChirps(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		viewerID, _ := userIDFromRequest(r, cfg.jwtSecret)
+		filter := streamFilter{viewerID: viewerID}
+
+		query := r.URL.Query()
+		if value := query.Get("author_id"); value != "" {
+			authorID, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid author_id", http.StatusBadRequest)
+				return
+			}
+			filter.authorID = authorID
+		}
+		if value := query.Get("timeline"); value != "" {
+			timeline, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "Invalid timeline flag", http.StatusBadRequest)
+				return
+			}
+			if timeline && viewerID == 0 {
+				w.WriteHeader(401)
+				return
+			}
+			filter.timeline = timeline
+		}
+
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = query.Get("last_event_id")
+		}
+		var resumeAfter int64
+		if lastEventID != "" {
+			var err error
+			resumeAfter, err = strconv.ParseInt(lastEventID, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+				return
+			}
+		}
+
+		controller := http.NewResponseController(w)
+		send := func(message string) error {
+			err := controller.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+			if err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return err
+			}
+			if _, err := fmt.Fprint(w, message); err != nil {
+				return err
+			}
+			return controller.Flush()
+		}
+
+		subscriber, replay, missed, err := db.SubscribeChirps(filter, resumeAfter)
+		if err != nil {
+			http.Error(w, "Could not subscribe to chirps", http.StatusInternalServerError)
+			return
+		}
+		defer db.stream.unsubscribe(subscriber)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		// Stop nginx and friends from buffering the stream
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(200)
+
+		if err := send(fmt.Sprintf("retry: %d\n\n", streamRetry)); err != nil {
+			return
+		}
+		if missed {
+			if err := send("event: reset\ndata: {}\n\n"); err != nil {
+				return
+			}
+		}
+		for _, event := range replay {
+			if err := send(formatChirpEvent(event)); err != nil {
+				return
+			}
+		}
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-subscriber.events:
+				// The stream dropped us for falling behind; the client reconnects
+				// and picks up from the backlog
+				if !ok {
+					return
+				}
+				if err := send(formatChirpEvent(event)); err != nil {
+					return
+				}
+			case <-heartbeat.C:
+				if err := send(": heartbeat\n\n"); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// formatChirpEvent renders an event in the Server-Sent Events format. Deleted
+// chirps only carry their ID and author.
+func formatChirpEvent(event chirpEvent) string {
+	var data []byte
+	if event.Type == eventChirpDeleted {
+		data, _ = json.Marshal(map[string]interface{}{
+			"id":        event.Chirp.ID,
+			"author_id": event.Chirp.Author_ID,
+		})
+	} else {
+		data, _ = json.Marshal(event.Chirp)
+	}
+	return fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errSanctionSelf = errors.New("moderators cannot sanction themselves")
+
+// suspended reports whether the user is serving a suspension at the given time.
+// Time-limited suspensions end on their own once Suspended_until has passed.
+func (user User) suspended(now time.Time) bool {
+	return user.Suspended_at != nil && (user.Suspended_until == nil || now.Before(*user.Suspended_until))
+}
+
+// isSuspended reports whether userID is currently suspended
+func (dbStructure DBStructure) isSuspended(userID int64) bool {
+	return dbStructure.Users[userID].suspended(time.Now())
+}
+
+// isShadowBanned reports whether userID's chirps are hidden from everyone but themselves
+func (dbStructure DBStructure) isShadowBanned(userID int64) bool {
+	return dbStructure.Users[userID].Shadow_banned
+}
+
+// GetSuspension returns the user if they are currently suspended, errUserNotFound otherwise
+func (db *DB) GetSuspension(userID int64) (User, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return User{}, err
+	}
+	user, found := dbStructure.Users[userID]
+	if !found || !user.suspended(time.Now()) {
+		return User{}, errUserNotFound
+	}
+	return user, nil
+}
+
+// suspend suspends a user until the given time, or indefinitely if until is nil
+func (dbStructure DBStructure) suspend(user User, until *time.Time) {
+	now := time.Now().UTC()
+	user.Suspended_at = &now
+	user.Suspended_until = until
+	dbStructure.Users[user.ID] = user
+}
+
+// SuspendUser suspends a user until the given time, or indefinitely if until is nil.
+// Suspended users can't log in or use their tokens and their chirps are hidden.
+func (db *DB) SuspendUser(moderatorID, userID int64, until *time.Time, note string) (User, error) {
+	return db.sanction(moderatorID, userID, func(dbStructure DBStructure, user User) User {
+		dbStructure.suspend(user, until)
+		dbStructure.logModeration(ModerationLogEntry{User_ID: user.ID, Moderator_ID: moderatorID, Action: resolutionSuspend, Until: until, Note: note})
+		return dbStructure.Users[user.ID]
+	})
+}
+
+// UnsuspendUser lifts a user's suspension early
+func (db *DB) UnsuspendUser(moderatorID, userID int64, note string) (User, error) {
+	return db.sanction(moderatorID, userID, func(dbStructure DBStructure, user User) User {
+		user.Suspended_at = nil
+		user.Suspended_until = nil
+		dbStructure.Users[user.ID] = user
+		dbStructure.logModeration(ModerationLogEntry{User_ID: user.ID, Moderator_ID: moderatorID, Action: "unsuspend", Note: note})
+		return user
+	})
+}
+
+// SetShadowBan shadow-bans or reinstates a user. A shadow-banned user can keep
+// using Chirpy and sees their own chirps, but nobody else does.
+func (db *DB) SetShadowBan(moderatorID, userID int64, banned bool, note string) (User, error) {
+	return db.sanction(moderatorID, userID, func(dbStructure DBStructure, user User) User {
+		user.Shadow_banned = banned
+		dbStructure.Users[user.ID] = user
+		action := "shadow_ban"
+		if !banned {
+			action = "lift_shadow_ban"
+		}
+		dbStructure.logModeration(ModerationLogEntry{User_ID: user.ID, Moderator_ID: moderatorID, Action: action, Note: note})
+		return user
+	})
+}
+
+// sanction applies a moderator's change to a user after checking who is allowed to make it
+func (db *DB) sanction(moderatorID, userID int64, apply func(DBStructure, User) User) (User, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return User{}, err
+	}
+	if !dbStructure.isModerator(moderatorID) {
+		return User{}, errNotModerator
+	}
+	if moderatorID == userID {
+		return User{}, errSanctionSelf
+	}
+	user, found := dbStructure.Users[userID]
+	if !found {
+		return User{}, errUserNotFound
+	}
+
+	user = apply(dbStructure, user)
+
+	err = db.writeDB(dbStructure)
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
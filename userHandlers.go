@@ -2,14 +2,21 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/gorilla/mux"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// handlePattern is what a handle may look like, without the leading @
+var handlePattern = regexp.MustCompile(`^[A-Za-z0-9_]{1,15}$`)
+
 func postUsers(db *DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var reqBody map[string]string
@@ -18,6 +25,10 @@ func postUsers(db *DB) http.HandlerFunc {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
+		if reqBody["handle"] != "" && !handlePattern.MatchString(reqBody["handle"]) {
+			http.Error(w, "Invalid handle", http.StatusBadRequest)
+			return
+		}
 		encPW, err := bcrypt.GenerateFromPassword([]byte(reqBody["password"]), bcrypt.DefaultCost)
 		if err != nil {
 			http.Error(w, "Could not use password", http.StatusInternalServerError)
@@ -26,6 +37,10 @@ func postUsers(db *DB) http.HandlerFunc {
 		reqBody["password"] = string(encPW)
 
 		user, err := db.CreateUser(reqBody)
+		if errors.Is(err, errHandleTaken) {
+			http.Error(w, "Handle is already taken", http.StatusConflict)
+			return
+		}
 		if err != nil {
 			http.Error(w, "Could not create user", http.StatusInternalServerError)
 			return
@@ -38,6 +53,7 @@ func postUsers(db *DB) http.HandlerFunc {
 		response := map[string]interface{}{
 			"id":                 user.ID,
 			"email":              user.Email,
+			"handle":             user.Handle,
 			"expires_in_seconds": user.Expires_in_seconds,
 			"is_chirpy_red":      user.Is_chirpy_red,
 		}
@@ -58,24 +74,13 @@ func loginUser(db *DB, cfg *apiConfig) http.HandlerFunc {
 			return
 		}
 
-		users, err := db.loadDB()
-		if err != nil {
-			http.Error(w, "Issue getting users", 404)
+		user, err := db.GetUserByEmail(reqBody.Email)
+		if errors.Is(err, errUserNotFound) {
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
 			return
 		}
-
-		var user User
-		userExists := false
-		for _, u := range users.Users {
-			if u.Email == reqBody.Email {
-				user = u
-				userExists = true
-				break
-			}
-		}
-
-		if !userExists {
-			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		if err != nil {
+			http.Error(w, "Issue getting users", 404)
 			return
 		}
 
@@ -86,6 +91,11 @@ func loginUser(db *DB, cfg *apiConfig) http.HandlerFunc {
 			return
 		}
 
+		if user.suspended(time.Now()) {
+			writeSuspended(w, user)
+			return
+		}
+
 		expiresInSeconds := int64(86400 * 60) //seconds in 60 days
 		user.Expires_in_seconds = expiresInSeconds
 		user.Expires_in_seconds = reqBody.Expires_in_seconds
@@ -95,12 +105,16 @@ func loginUser(db *DB, cfg *apiConfig) http.HandlerFunc {
 
 		user.Token = refreshToken
 
-		users.Users[user.ID] = user
-		db.writeDB(users)
+		err = db.SaveLogin(user.ID, refreshToken, user.Expires_in_seconds)
+		if err != nil {
+			http.Error(w, "Could not log in", http.StatusInternalServerError)
+			return
+		}
 
 		response := map[string]interface{}{
 			"id":            user.ID,
 			"email":         user.Email,
+			"handle":        user.Handle,
 			"token":         token,
 			"refresh_token": refreshToken,
 			"is_chirpy_red": user.Is_chirpy_red,
@@ -121,6 +135,10 @@ func updateUser(db *DB, cfg *apiConfig) http.HandlerFunc {
 			http.Error(w, "Invalid request", http.StatusBadRequest)
 			return
 		}
+		if reqBody.Handle != "" && !handlePattern.MatchString(reqBody.Handle) {
+			http.Error(w, "Invalid handle", http.StatusBadRequest)
+			return
+		}
 
 		claims, err := jwtValidate(r, cfg.jwtSecret)
 		if err != nil {
@@ -137,32 +155,37 @@ func updateUser(db *DB, cfg *apiConfig) http.HandlerFunc {
 				return
 			}
 
-			users, err := db.loadDB()
+			encPW, err := bcrypt.GenerateFromPassword([]byte(reqBody.Password), bcrypt.DefaultCost)
 			if err != nil {
-				fmt.Println("Issue loading users")
-				w.WriteHeader(401)
+				http.Error(w, "Could not use password", http.StatusInternalServerError)
 				return
 			}
 
-			updatedUser = users.Users[int64(id)]
-			updatedUser.Email = reqBody.Email
+			// Handles change through the profile so they are checked for clashes under the lock
+			if reqBody.Handle != "" {
+				_, err := db.UpdateProfile(int64(id), profileUpdate{Handle: &reqBody.Handle})
+				if errors.Is(err, errHandleTaken) {
+					http.Error(w, "Handle is already taken", http.StatusConflict)
+					return
+				}
+				if err != nil {
+					w.WriteHeader(401)
+					return
+				}
+			}
 
-			encPW, err := bcrypt.GenerateFromPassword([]byte(reqBody.Password), bcrypt.DefaultCost)
+			updatedUser, err = db.UpdateCredentials(int64(id), reqBody.Email, string(encPW))
 			if err != nil {
-				http.Error(w, "Could not use password", http.StatusInternalServerError)
+				fmt.Println("Issue updating user")
 				w.WriteHeader(401)
 				return
 			}
-			reqBody.Password = string(encPW)
-			updatedUser.Password = reqBody.Password
-
-			users.Users[int64(id)] = updatedUser
-			db.writeDB(users)
 		}
 
 		response := map[string]interface{}{
 			"id":            updatedUser.ID,
 			"email":         updatedUser.Email,
+			"handle":        updatedUser.Handle,
 			"is_chirpy_red": updatedUser.Is_chirpy_red,
 		}
 
@@ -180,20 +203,14 @@ func refreshUser(w http.ResponseWriter, r *http.Request, db *DB, cfg *apiConfig)
 
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
-	users, _ := db.loadDB()
-	resp := ""
-
-	token := ""
-	for _, user := range users.Users {
-		if user.Token == tokenString {
-			resp = user.Token
-			token = jwtCreation(user, cfg.jwtSecret)
+	user, err := db.GetUserByRefreshToken(tokenString)
+	if err == nil {
+		if user.suspended(time.Now()) {
+			writeSuspended(w, user)
+			return nil
 		}
-	}
-
-	if resp != "" {
 		response := map[string]interface{}{
-			"token": token,
+			"token": jwtCreation(user, cfg.jwtSecret),
 		}
 		w.WriteHeader(200)
 		fmt.Println(response)
@@ -215,16 +232,10 @@ func revokeUser(w http.ResponseWriter, r *http.Request, db *DB) error {
 
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
 
-	users, _ := db.loadDB()
-
-	for _, user := range users.Users {
-		if user.Token == tokenString {
-			updatedUser := user
-			updatedUser.Token = ""
-
-			users.Users[user.ID] = updatedUser
-			db.writeDB(users)
-		}
+	err := db.RevokeRefreshToken(tokenString)
+	if err != nil {
+		http.Error(w, "Could not revoke token", http.StatusInternalServerError)
+		return err
 	}
 
 	w.WriteHeader(204)
@@ -254,19 +265,94 @@ func polkaHandler(db *DB, cfg *apiConfig) http.HandlerFunc {
 		}
 		event := reqBody.Event
 		id := reqBody.Data.UserID
-		users, _ := db.loadDB()
-		user := users.Users[id]
-
 		if event != "user.upgraded" {
 			w.WriteHeader(204)
 			return
 		} else {
-			user.Is_chirpy_red = true
-			users.Users[int64(id)] = user
-			db.writeDB(users)
+			err := db.UpgradeUser(id)
+			if errors.Is(err, errUserNotFound) {
+				w.WriteHeader(404)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Could not upgrade user", http.StatusInternalServerError)
+				return
+			}
 
 			w.WriteHeader(204)
 			return
 		}
 	}
 }
+
+func getUserLikes(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		viewerID, _ := userIDFromRequest(r, cfg.jwtSecret)
+
+		vars := mux.Vars(r)
+		userID, err := strconv.ParseInt(vars["userID"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", 404)
+			return
+		}
+
+		chirps, err := db.GetLikedChirps(userID, viewerID)
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(404)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not retrieve likes", http.StatusInternalServerError)
+			return
+		}
+		views, err := db.chirpViews(chirps, viewerID)
+		if err != nil {
+			http.Error(w, "Could not retrieve likes", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(views)
+	}
+}
+
+// userSummary is the part of a user's profile shown next to their chirps and in user lists
+type userSummary struct {
+	ID           int64  `json:"id"`
+	Handle       string `json:"handle"`
+	Display_name string `json:"display_name"`
+	Avatar_url   string `json:"avatar_url"`
+}
+
+// publicUser returns the fields of a user anyone may see
+func publicUser(user User) userSummary {
+	return userSummary{
+		ID:           user.ID,
+		Handle:       user.Handle,
+		Display_name: user.Display_name,
+		Avatar_url:   user.Avatar_url,
+	}
+}
+
+func getEntitlements(db *DB, cfg *apiConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := userIDFromRequest(r, cfg.jwtSecret)
+		if err != nil {
+			w.WriteHeader(401)
+			return
+		}
+
+		entitlements, err := db.GetEntitlements(userID)
+		if errors.Is(err, errUserNotFound) {
+			w.WriteHeader(401)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Could not retrieve entitlements", http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(entitlements)
+	}
+}
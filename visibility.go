@@ -0,0 +1,54 @@
+package main
+
+import "errors"
+
+// Who a chirp is meant for
+const (
+	visibilityPublic = "public"
+	// Followers-only chirps are seen by the author's followers
+	visibilityFollowers = "followers"
+	// Direct chirps are seen by the users they mention
+	visibilityDirect = "direct"
+)
+
+var (
+	errInvalidVisibility = errors.New("visibility must be public, followers or direct")
+	errNotShareable      = errors.New("only public chirps can be rechirped or quoted")
+)
+
+func validVisibility(visibility string) bool {
+	return visibility == visibilityPublic || visibility == visibilityFollowers || visibility == visibilityDirect
+}
+
+// inAudience reports whether viewerID is among the people the author chose to show the chirp to.
+// viewerID is 0 for anonymous requests.
+func (dbStructure DBStructure) inAudience(chirp Chirp, viewerID int64) bool {
+	if viewerID != 0 && viewerID == int64(chirp.Author_ID) {
+		return true
+	}
+	switch chirp.Visibility {
+	case visibilityFollowers:
+		_, follows := dbStructure.Follows[viewerID][int64(chirp.Author_ID)]
+		return viewerID != 0 && follows
+	case visibilityDirect:
+		for _, mention := range chirp.Mentions {
+			if viewerID != 0 && mention.User_ID == viewerID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// chirpVisibility is the visibility a new chirp gets. When its author didn't pick one,
+// replies stay as visible as the chirp they answer and everything else is public.
+func (dbStructure DBStructure) chirpVisibility(opts ChirpOptions) string {
+	if opts.Visibility != "" {
+		return opts.Visibility
+	}
+	if parent, found := dbStructure.Chirps[opts.InReplyTo]; found && opts.InReplyTo != 0 {
+		return parent.Visibility
+	}
+	return visibilityPublic
+}